@@ -12,18 +12,18 @@
 package apiserver
 
 import (
-	"code.google.com/p/go-uuid/uuid"
 	"crypto/tls"
-
 	"encoding/json"
 	"flag"
 	"github.com/trusch/susi/authentification"
 	"github.com/trusch/susi/events"
+	"github.com/trusch/susi/permissions"
 	"github.com/trusch/susi/session"
 	"github.com/trusch/susi/state"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -41,6 +41,12 @@ type ApiMessage struct {
 	ReturnAddr string      `json:"returnaddr,omitempty"`
 	Payload    interface{} `json:"payload,omitempty"`
 	Username   string      `json:"username,omitempty"`
+	Offset     uint64      `json:"offset,omitempty"`
+	Retain     bool        `json:"retain,omitempty"`
+	EventId    uint64      `json:"eventid,string,omitempty"`
+	TraceId    uint64      `json:"traceid,string,omitempty"`
+	ParentId   uint64      `json:"parentid,string,omitempty"`
+	DedupeId   string      `json:"dedupeid,omitempty"`
 }
 
 func NewApiMessage() *ApiMessage {
@@ -55,8 +61,10 @@ type Connection struct {
 	conn          net.Conn
 	sender        *SyncedSender
 	subscribtions subscribtionsType
+	consumers     subscribtionsType
 	username      string
 	authlevel     uint8
+	roles         []string
 	session       uint64
 }
 
@@ -65,6 +73,7 @@ func NewConnection(conn net.Conn) *Connection {
 	connection.conn = conn
 	connection.sender = NewSyncedSender(conn)
 	connection.subscribtions = make(subscribtionsType)
+	connection.consumers = make(subscribtionsType)
 	connection.authlevel = 3
 	connection.username = "anonymous"
 	return connection
@@ -80,11 +89,70 @@ func (conn *Connection) sendStatusMessage(id int64, key, msg string) {
 	conn.sender.Send(packet)
 }
 
+/*
+Network clients must not stall the event system, so their subscriptions drop
+the oldest events by default. A client can choose another policy by sending
+{"policy": "block|drop-newest|drop-oldest|disconnect"} as subscribe payload.
+Reconnecting clients can catch up on journaled events by adding
+"offset" (the offset of the first missed event) or "since" (unix timestamp).
+Clients subscribing with the same "group" share the events of the topic,
+balanced by "balance": "round-robin" (default) or "least-loaded".
+*/
+func subscribeOptions(req *ApiMessage) (events.SubscribeOptions, error) {
+	options := events.SubscribeOptions{
+		Policy: events.DROP_OLDEST,
+	}
+	if payload, ok := req.Payload.(map[string]interface{}); ok {
+		if name, ok := payload["policy"].(string); ok {
+			policy, err := events.ParseBackpressurePolicy(name)
+			if err != nil {
+				return options, err
+			}
+			options.Policy = policy
+		}
+		if offset, ok := payload["offset"].(float64); ok {
+			options.FromOffset = uint64(offset)
+		}
+		if since, ok := payload["since"].(float64); ok {
+			options.FromTime = time.Unix(int64(since), 0)
+		}
+		if group, ok := payload["group"].(string); ok {
+			options.Group = group
+		}
+		if name, ok := payload["balance"].(string); ok {
+			balance, err := events.ParseBalancePolicy(name)
+			if err != nil {
+				return options, err
+			}
+			options.Balance = balance
+		}
+		if spec, ok := payload["filter"].(map[string]interface{}); ok {
+			filter, err := events.ParseFilter(spec)
+			if err != nil {
+				return options, err
+			}
+			options.Filter = filter
+		}
+	}
+	return options, nil
+}
+
 func (conn *Connection) subscribe(req *ApiMessage) {
 	topic := req.Key
 	if _, ok := conn.subscribtions[topic]; !ok {
-		eventChan, unsubscribeChan := events.Subscribe(topic, req.AuthLevel)
-		closeChan := make(chan bool)
+		options, err := subscribeOptions(req)
+		if err != nil {
+			conn.sendStatusMessage(req.Id, "error", err.Error())
+			return
+		}
+		options.Username = conn.username
+		options.Roles = conn.roles
+		eventChan, unsubscribeChan, err := events.TrySubscribe(topic, req.AuthLevel, options)
+		if err != nil {
+			conn.sendStatusMessage(req.Id, "error", err.Error())
+			return
+		}
+		closeChan := make(chan bool, 1)
 		conn.subscribtions[topic] = closeChan
 		go func() {
 			defer func() {
@@ -92,8 +160,12 @@ func (conn *Connection) subscribe(req *ApiMessage) {
 			}()
 			for {
 				select {
-				case event := <-eventChan:
+				case event, ok := <-eventChan:
 					{
+						if !ok {
+							conn.sendStatusMessage(req.Id, "error", "subscription to "+topic+" was closed")
+							return
+						}
 						resp := NewApiMessage()
 						resp.AuthLevel = event.AuthLevel
 						resp.Id = req.Id
@@ -102,6 +174,11 @@ func (conn *Connection) subscribe(req *ApiMessage) {
 						resp.Payload = event.Payload
 						resp.Username = event.Username
 						resp.ReturnAddr = event.ReturnAddr
+						resp.Offset = event.Offset
+						resp.Retain = event.Retain
+						resp.EventId = event.Id
+						resp.TraceId = event.TraceId
+						resp.ParentId = event.ParentId
 						err := conn.sender.Send(resp)
 						if err != nil {
 							log.Print(err)
@@ -122,6 +199,116 @@ func (conn *Connection) subscribe(req *ApiMessage) {
 	}
 }
 
+/*
+Events of a durable consumer are sent as "event" messages with the id of the
+consume request. Clients confirm them by sending "ack" or "nack" with the
+consumer name as key and the eventid of the event. The consume payload can
+set "redelivery" (seconds) and "maxattempts". Publishers which retry send the
+same "dedupeid", so consumers get the event only once.
+*/
+func consumerOptions(req *ApiMessage) events.ConsumerOptions {
+	options := events.ConsumerOptions{}
+	if payload, ok := req.Payload.(map[string]interface{}); ok {
+		if redelivery, ok := payload["redelivery"].(float64); ok {
+			options.Redelivery = time.Duration(redelivery * float64(time.Second))
+		}
+		if attempts, ok := payload["maxattempts"].(float64); ok {
+			options.MaxAttempts = int(attempts)
+		}
+	}
+	return options
+}
+
+func (conn *Connection) consume(req *ApiMessage) {
+	name, topic := req.Key, ""
+	if payload, ok := req.Payload.(map[string]interface{}); ok {
+		topic, _ = payload["topic"].(string)
+	}
+	if name == "" || topic == "" {
+		conn.sendStatusMessage(req.Id, "error", "consume needs a consumer name as key and a topic in the payload")
+		return
+	}
+	if _, ok := conn.consumers[name]; ok {
+		conn.sendStatusMessage(req.Id, "error", "you are allready consuming "+name)
+		return
+	}
+	options := consumerOptions(req)
+	options.Username = conn.username
+	options.Roles = conn.roles
+	eventChan, detachChan, err := events.Consume(name, topic, req.AuthLevel, options)
+	if err != nil {
+		conn.sendStatusMessage(req.Id, "error", err.Error())
+		return
+	}
+	closeChan := make(chan bool, 1)
+	conn.consumers[name] = closeChan
+	go func() {
+		defer func() {
+			detachChan <- true
+		}()
+		for {
+			select {
+			case event, ok := <-eventChan:
+				{
+					if !ok {
+						conn.sendStatusMessage(req.Id, "error", "consumer "+name+" was deleted")
+						return
+					}
+					resp := NewApiMessage()
+					resp.AuthLevel = event.AuthLevel
+					resp.Id = req.Id
+					resp.Type = "event"
+					resp.Key = event.Topic
+					resp.Payload = event.Payload
+					resp.Username = event.Username
+					resp.ReturnAddr = event.ReturnAddr
+					resp.Offset = event.Offset
+					resp.EventId = event.Id
+					resp.TraceId = event.TraceId
+					resp.ParentId = event.ParentId
+					if err := conn.sender.Send(resp); err != nil {
+						log.Print(err)
+						return
+					}
+				}
+			case <-closeChan:
+				{
+					return
+				}
+			}
+		}
+	}()
+	conn.sendStatusMessage(req.Id, "ok", "successfully attached to consumer "+name)
+}
+
+func (conn *Connection) unconsume(req *ApiMessage) {
+	if ch, ok := conn.consumers[req.Key]; ok {
+		ch <- true
+		delete(conn.consumers, req.Key)
+		conn.sendStatusMessage(req.Id, "ok", "successfully detached from consumer "+req.Key)
+	} else {
+		conn.sendStatusMessage(req.Id, "error", "you are not consuming "+req.Key)
+	}
+}
+
+func (conn *Connection) acknowledge(req *ApiMessage, ack bool) {
+	if _, ok := conn.consumers[req.Key]; !ok {
+		conn.sendStatusMessage(req.Id, "error", "you are not consuming "+req.Key)
+		return
+	}
+	var ok bool
+	if ack {
+		ok = events.Ack(req.Key, req.EventId)
+	} else {
+		ok = events.Nack(req.Key, req.EventId)
+	}
+	if ok {
+		conn.sendStatusMessage(req.Id, "ok", "successfully confirmed event of "+req.Key)
+	} else {
+		conn.sendStatusMessage(req.Id, "error", "no such event in flight for "+req.Key)
+	}
+}
+
 func (conn *Connection) unsubscribe(req *ApiMessage) {
 	topic := req.Key
 	if ch, ok := conn.subscribtions[topic]; ok {
@@ -133,26 +320,118 @@ func (conn *Connection) unsubscribe(req *ApiMessage) {
 	}
 }
 
+/*
+State operations need the permission state:read:<key> or state:write:<key>,
+pop and dequeue change the state and need write access.
+*/
+func (conn *Connection) mayAccessState(req *ApiMessage, action, key string) bool {
+	if permissions.Check(conn.roles, req.AuthLevel, permissions.STATE, action, key) {
+		return true
+	}
+	conn.sendStatusMessage(req.Id, "error", "not allowed to "+action+" "+key)
+	return false
+}
+
+/*
+A transaction carries its operations as payload, e.g.
+[{"type": "cas", "key": "devices.lamp", "expected": "off", "value": "on"}, {"type": "get", "key": "devices.count"}].
+They are executed atomically, the response holds the result of each operation.
+*/
+func (conn *Connection) transaction(req *ApiMessage) {
+	ops, err := state.ParseOperations(req.Payload)
+	if err != nil {
+		conn.sendStatusMessage(req.Id, "error", err.Error())
+		return
+	}
+	for _, op := range ops {
+		action := permissions.WRITE
+		if op.Type == state.OP_GET {
+			action = permissions.READ
+		}
+		if !conn.mayAccessState(req, action, op.Key) {
+			return
+		}
+	}
+	values, err := state.Transaction(ops)
+	if err != nil {
+		conn.sendStatusMessage(req.Id, "error", err.Error())
+		return
+	}
+	packet := new(ApiMessage)
+	packet.Id = req.Id
+	packet.Type = "response"
+	packet.Key = req.Key
+	packet.Payload = values
+	conn.sender.Send(packet)
+}
+
+/*
+Atomic state operations awnser with {"value": <the value afterwards>, "success": <whether it changed>}.
+compareandset needs {"expected": ..., "value": ...} as payload, increment takes
+an optional delta (default 1) and setifabsent the value to set.
+*/
+func (conn *Connection) atomic(req *ApiMessage) {
+	var value interface{}
+	var err error
+	success := false
+	switch req.Type {
+	case "compareandset":
+		{
+			payload, ok := req.Payload.(map[string]interface{})
+			if !ok {
+				conn.sendStatusMessage(req.Id, "error", "compareandset needs expected and value")
+				return
+			}
+			value, success, err = state.CompareAndSet(req.Key, payload["expected"], payload["value"])
+		}
+	case "increment":
+		{
+			delta := float64(1)
+			if number, ok := req.Payload.(float64); ok {
+				delta = number
+			}
+			var number float64
+			number, err = state.Increment(req.Key, delta)
+			value, success = number, true
+		}
+	case "setifabsent":
+		{
+			value, success, err = state.SetIfAbsent(req.Key, req.Payload)
+		}
+	}
+	if err != nil {
+		conn.sendStatusMessage(req.Id, "error", err.Error())
+		return
+	}
+	packet := new(ApiMessage)
+	packet.Id = req.Id
+	packet.Type = "response"
+	packet.Key = req.Key
+	packet.Payload = map[string]interface{}{
+		"value":   value,
+		"success": success,
+	}
+	conn.sender.Send(packet)
+}
+
 func (conn *Connection) checkUser(username, password string) bool {
-	awnserTopic := uuid.New()
-	awnserChan, closeChan := events.Subscribe(awnserTopic, 0)
-	event := events.NewEvent("authentification::checkuser", map[string]interface{}{
+	data, err := events.Request("authentification::checkuser", map[string]interface{}{
 		"username": username,
 		"password": password,
 	})
-	event.ReturnAddr = awnserTopic
-	event.AuthLevel = 0
-	events.Publish(event)
-	awnser_ := <-awnserChan
-	closeChan <- true
-	awnser := awnser_.Payload.(*authentification.AwnserData)
-	if awnser.Success {
-		user := awnser.Message.(*authentification.User)
-		conn.username = user.Username
-		conn.authlevel = user.AuthLevel
-		return true
+	if err != nil {
+		log.Print(err)
+		return false
 	}
-	return false
+	user := new(authentification.User)
+	if err := events.DecodeAs(data, user); err != nil {
+		log.Print(err)
+		return false
+	}
+	conn.username = user.Username
+	conn.authlevel = user.AuthLevel
+	conn.roles = user.Roles
+	return true
 }
 
 func HandleConnection(conn net.Conn, sessionId uint64) {
@@ -168,11 +447,15 @@ func HandleConnection(conn net.Conn, sessionId uint64) {
 	connection := NewConnection(conn)
 	connection.username = username
 	connection.authlevel = authlevel
+	connection.roles, _ = session.Data["roles"].([]string)
 	connection.session = sessionId
 	defer func() {
 		for _, ch := range connection.subscribtions {
 			ch <- true
 		}
+		for _, ch := range connection.consumers {
+			ch <- true
+		}
 		connection.sender.Close()
 		conn.Close()
 	}()
@@ -196,36 +479,71 @@ func HandleConnection(conn net.Conn, sessionId uint64) {
 			{
 				connection.unsubscribe(&req)
 			}
+		case "consume":
+			{
+				connection.consume(&req)
+			}
+		case "unconsume":
+			{
+				connection.unconsume(&req)
+			}
+		case "ack":
+			{
+				connection.acknowledge(&req, true)
+			}
+		case "nack":
+			{
+				connection.acknowledge(&req, false)
+			}
 		case "publish":
 			{
 				event := events.NewEvent(req.Key, req.Payload)
+				//clients retry with the same dedupeid, so durable consumers can drop duplicates
+				event.DedupeId = req.DedupeId
 				event.AuthLevel = req.AuthLevel
+				event.Username = connection.username
+				event.Roles = connection.roles
 				event.ReturnAddr = req.ReturnAddr
 				event.SessionId = session.Id
-				found := events.Publish(event)
-				if found {
+				event.Retain = req.Retain
+				event.TraceId = req.TraceId
+				event.ParentId = req.ParentId
+				events.MarkResponder(event, "session:"+strconv.FormatUint(session.Id, 10))
+				if err := events.TryPublish(event); err == nil {
 					connection.sendStatusMessage(req.Id, "ok", "successfully published event to "+req.Key)
 				} else {
-					connection.sendStatusMessage(req.Id, "error", "nobody is subscribed to "+req.Key)
+					connection.sendStatusMessage(req.Id, "error", err.Error())
 				}
 			}
 		case "set":
 			{
+				if !connection.mayAccessState(&req, permissions.WRITE, req.Key) {
+					break
+				}
 				state.Set(req.Key, req.Payload)
 				connection.sendStatusMessage(req.Id, "ok", "successfully saved data to "+req.Key)
 			}
 		case "push":
 			{
+				if !connection.mayAccessState(&req, permissions.WRITE, req.Key) {
+					break
+				}
 				state.Push(req.Key, req.Payload)
 				connection.sendStatusMessage(req.Id, "ok", "successfully pushed data to "+req.Key)
 			}
 		case "enqueue":
 			{
+				if !connection.mayAccessState(&req, permissions.WRITE, req.Key) {
+					break
+				}
 				state.Enqueue(req.Key, req.Payload)
 				connection.sendStatusMessage(req.Id, "ok", "successfully queued data to "+req.Key)
 			}
 		case "get":
 			{
+				if !connection.mayAccessState(&req, permissions.READ, req.Key) {
+					break
+				}
 				data := state.Get(req.Key)
 				packet := new(ApiMessage)
 				packet.Id = req.Id
@@ -236,6 +554,9 @@ func HandleConnection(conn net.Conn, sessionId uint64) {
 			}
 		case "pop":
 			{
+				if !connection.mayAccessState(&req, permissions.WRITE, req.Key) {
+					break
+				}
 				data := state.Pop(req.Key)
 				packet := new(ApiMessage)
 				packet.Id = req.Id
@@ -246,6 +567,9 @@ func HandleConnection(conn net.Conn, sessionId uint64) {
 			}
 		case "dequeue":
 			{
+				if !connection.mayAccessState(&req, permissions.WRITE, req.Key) {
+					break
+				}
 				data := state.Dequeue(req.Key)
 				packet := new(ApiMessage)
 				packet.Id = req.Id
@@ -256,9 +580,23 @@ func HandleConnection(conn net.Conn, sessionId uint64) {
 			}
 		case "unset":
 			{
+				if !connection.mayAccessState(&req, permissions.WRITE, req.Key) {
+					break
+				}
 				state.Unset(req.Key)
 				connection.sendStatusMessage(req.Id, "ok", "successfully unset data from "+req.Key)
 			}
+		case "transaction":
+			{
+				connection.transaction(&req)
+			}
+		case "compareandset", "increment", "setifabsent":
+			{
+				if !connection.mayAccessState(&req, permissions.WRITE, req.Key) {
+					break
+				}
+				connection.atomic(&req)
+			}
 		case "login":
 			{
 				username := req.Key
@@ -276,6 +614,7 @@ func HandleConnection(conn net.Conn, sessionId uint64) {
 			{
 				connection.username = "anonymous"
 				connection.authlevel = 3
+				connection.roles = nil
 				connection.sendStatusMessage(req.Id, "ok", "successfully logged out")
 			}
 		default:
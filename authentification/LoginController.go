@@ -39,10 +39,14 @@ func GoLoginController() {
 						events.AwnserError(event, "malformed payload")
 						break
 					}
-					user, err := events.Request("authentification::checkuser", map[string]interface{}{
+					data, err := events.Request("authentification::checkuser", map[string]interface{}{
 						"username": username,
 						"password": password,
 					})
+					user := new(User)
+					if err == nil {
+						err = events.DecodeAs(data, user)
+					}
 					if err == nil {
 						sessionData, err := events.Request("session::get", event.SessionId)
 						if err != nil {
@@ -52,7 +56,8 @@ func GoLoginController() {
 						}
 						session := sessionData.(*session.Session)
 						session.Data["username"] = username
-						session.Data["authlevel"] = uint8(user.(*User).AuthLevel)
+						session.Data["authlevel"] = user.AuthLevel
+						session.Data["roles"] = user.Roles
 						events.Awnser(event, map[string]interface{}{
 							"username": username,
 						})
@@ -71,6 +76,7 @@ func GoLoginController() {
 					}
 					sessionData.(*session.Session).Data["username"] = "anonymous"
 					sessionData.(*session.Session).Data["authlevel"] = uint8(3)
+					delete(sessionData.(*session.Session).Data, "roles")
 					events.Awnser(event, "successfully logged out")
 					break
 				}
@@ -86,6 +92,7 @@ func GoLoginController() {
 					events.Awnser(event, map[string]interface{}{
 						"username":  session.Data["username"],
 						"authlevel": session.Data["authlevel"],
+						"roles":     session.Data["roles"],
 					})
 					break
 				}
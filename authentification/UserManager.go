@@ -47,7 +47,7 @@ func NewUserManager() *UserManager {
 
 	return ptr
 }
-func (ptr *UserManager) AddUser(name, password string, authlevel uint8) bool {
+func (ptr *UserManager) AddUser(name, password string, authlevel uint8, roles ...string) bool {
 	cmd := userManagerCommand{
 		Type:   ADDUSER,
 		Return: make(chan interface{}),
@@ -55,6 +55,7 @@ func (ptr *UserManager) AddUser(name, password string, authlevel uint8) bool {
 			Username:  name,
 			Password:  password,
 			AuthLevel: authlevel,
+			Roles:     roles,
 		},
 	}
 	ptr.cmds <- cmd
@@ -73,6 +74,41 @@ func (ptr *UserManager) DelUser(name string) bool {
 	return (<-cmd.Return).(bool)
 }
 
+/*
+SetRoles replaces the roles of a user. Users without roles get the roles
+their authlevel maps to (see package permissions).
+*/
+func (ptr *UserManager) SetRoles(name string, roles []string) bool {
+	cmd := userManagerCommand{
+		Type:   SETROLES,
+		Return: make(chan interface{}),
+		User: &User{
+			Username: name,
+			Roles:    roles,
+		},
+	}
+	ptr.cmds <- cmd
+	return (<-cmd.Return).(bool)
+}
+
+/*
+GetUser returns the user without its password, nil if there is no such user.
+*/
+func (ptr *UserManager) GetUser(name string) *User {
+	cmd := userManagerCommand{
+		Type:   GETUSER,
+		Return: make(chan interface{}),
+		User: &User{
+			Username: name,
+		},
+	}
+	ptr.cmds <- cmd
+	if user, ok := (<-cmd.Return).(*User); ok {
+		return user
+	}
+	return nil
+}
+
 func (ptr *UserManager) CheckUser(name, password string) *User {
 	cmd := userManagerCommand{
 		Type:   CHECKUSER,
@@ -96,6 +132,7 @@ type User struct {
 	Username  string
 	Password  string
 	AuthLevel uint8
+	Roles     []string `json:",omitempty"`
 }
 
 func (user *User) HashPassword(rounds int) {
@@ -119,6 +156,8 @@ const (
 	ADDUSER userManagerCommandType = iota
 	DELUSER
 	CHECKUSER
+	SETROLES
+	GETUSER
 )
 
 type userManagerCommand struct {
@@ -177,6 +216,7 @@ MAINLOOP:
 							cmd.User.Password = ""
 							cmd.User.ID = user.ID
 							cmd.User.AuthLevel = user.AuthLevel
+							cmd.User.Roles = user.Roles
 							cmd.Return <- cmd.User
 							continue MAINLOOP
 						} else {
@@ -188,6 +228,33 @@ MAINLOOP:
 				}
 				cmd.Return <- nil
 			}
+		case SETROLES:
+			{
+				for _, user := range manager.users {
+					if user.Username == cmd.User.Username {
+						user.Roles = cmd.User.Roles
+						manager.Save()
+						cmd.Return <- true
+						continue MAINLOOP
+					}
+				}
+				cmd.Return <- false
+			}
+		case GETUSER:
+			{
+				for _, user := range manager.users {
+					if user.Username == cmd.User.Username {
+						cmd.Return <- &User{
+							ID:        user.ID,
+							Username:  user.Username,
+							AuthLevel: user.AuthLevel,
+							Roles:     user.Roles,
+						}
+						continue MAINLOOP
+					}
+				}
+				cmd.Return <- nil
+			}
 		}
 	}
 }
@@ -227,12 +294,24 @@ type AwnserData struct {
 
 var userManagerRef *UserManager
 
+/*
+GetUser returns the user without its password, nil if there is no such user
+or the user manager was not started.
+*/
+func GetUser(name string) *User {
+	if userManagerRef == nil {
+		return nil
+	}
+	return userManagerRef.GetUser(name)
+}
+
 func GoUserManager() {
 	userManager := NewUserManager()
 	userManagerRef = userManager
 	addUserChan, _ := events.Subscribe("authentification::adduser", 0)
 	delUserChan, _ := events.Subscribe("authentification::deluser", 0)
 	checkUserChan, _ := events.Subscribe("authentification::checkuser", 0)
+	setRolesChan, _ := events.Subscribe("authentification::setroles", 0)
 
 	awnserEvent := func(event *events.Event, success bool, message interface{}) {
 		log.Print(message)
@@ -279,8 +358,9 @@ func GoUserManager() {
 								log.Printf("failed parsing authlevel: %T", authlevel_)
 							}
 						}
+						roles := parseRoles(payload["roles"])
 						if ok1 && ok2 && ok3 {
-							if success := userManager.AddUser(username, password, authlevel); success {
+							if success := userManager.AddUser(username, password, authlevel, roles...); success {
 								log.Print("successfully added user " + username)
 								awnserEvent(event, true, "")
 							} else {
@@ -338,11 +418,52 @@ func GoUserManager() {
 						awnserEvent(event, false, "malformed payload, need 'username' field")
 					}
 				}
+			case event := <-setRolesChan:
+				{
+					if event.AuthLevel > 0 {
+						awnserEvent(event, false, "wrong authlevel to use authentification::setroles. need authlevel 0.")
+						continue
+					}
+					if payload, ok := event.Payload.(map[string]interface{}); ok {
+						username, ok := payload["username"].(string)
+						if ok {
+							if success := userManager.SetRoles(username, parseRoles(payload["roles"])); success {
+								awnserEvent(event, true, "")
+							} else {
+								awnserEvent(event, false, "no such user")
+							}
+						} else {
+							awnserEvent(event, false, "malformed payload, need 'username' and 'roles' fields")
+						}
+					} else {
+						awnserEvent(event, false, "malformed payload, need 'username' and 'roles' fields")
+					}
+				}
 			}
 		}
 	}()
 }
 
+func parseRoles(data interface{}) []string {
+	switch list := data.(type) {
+	case []string:
+		{
+			return list
+		}
+	case []interface{}:
+		{
+			roles := make([]string, 0, len(list))
+			for _, role := range list {
+				if name, ok := role.(string); ok {
+					roles = append(roles, name)
+				}
+			}
+			return roles
+		}
+	}
+	return nil
+}
+
 func Go() {
 	GoUserManager()
 	GoLoginController()
@@ -350,3 +350,19 @@ func TestLoadSave(t *testing.T) {
 	userManagerRef.Load()
 	assert(t, len(userManagerRef.users) == 0, "user list should zero entries: %v", userManagerRef.users)
 }
+
+func TestSetRoles(t *testing.T) {
+	userManagerRef.usersFile = "/tmp/users.json"
+	os.Remove("/tmp/users.json")
+	userManagerRef.Load()
+	defer os.Remove("/tmp/users.json")
+	userManagerRef.AddUser("operator", "secret", 3, "operator")
+	user := userManagerRef.CheckUser("operator", "secret")
+	assert(t, user != nil && len(user.Roles) == 1 && user.Roles[0] == "operator", "roles should be returned on check: %v", user)
+
+	assert(t, userManagerRef.SetRoles("operator", []string{"operator", "auditor"}), "setting roles should succeed")
+	assert(t, !userManagerRef.SetRoles("nobody", nil), "setting roles of unknown users should fail")
+	userManagerRef.Load()
+	user = userManagerRef.CheckUser("operator", "secret")
+	assert(t, user != nil && len(user.Roles) == 2, "roles should be saved: %v", user)
+}
@@ -17,16 +17,22 @@ import (
 	"github.com/trusch/susi/events"
 	"net"
 	"strings"
+	"sync"
 )
 
 type RemoteEventCollector struct {
 	NewHostChan chan *events.Event
 	OwnNames    []string
+
+	//last journal offset seen per host, used to catch up after reconnects
+	offsets     map[string]uint64
+	offsetsLock sync.Mutex
 }
 
 func New(names []string) *RemoteEventCollector {
 	ptr := new(RemoteEventCollector)
 	ptr.OwnNames = []string{}
+	ptr.offsets = make(map[string]uint64)
 	if names != nil {
 		ptr.OwnNames = names
 	}
@@ -45,10 +51,11 @@ func New(names []string) *RemoteEventCollector {
 		go func(name string) {
 			ch, _ := events.Subscribe("*@"+name, 0)
 			for remoteEvent := range ch {
-				parts := strings.Split(remoteEvent.Topic, "@")
-				key := parts[0]
-				targetName := parts[1]
-				event := events.NewEvent(key, remoteEvent.Payload)
+				key, targetName, ok := ptr.SplitTarget(remoteEvent.Topic)
+				if !ok {
+					continue
+				}
+				event := events.NewChildEvent(remoteEvent, key, remoteEvent.Payload)
 				event.AuthLevel = remoteEvent.AuthLevel
 				event.ReturnAddr = remoteEvent.ReturnAddr
 				if payload, ok := remoteEvent.Payload.(map[string]interface{}); ok {
@@ -67,6 +74,19 @@ func New(names []string) *RemoteEventCollector {
 	return ptr
 }
 
+/*
+SplitTarget splits a remote topic like "foo::bar@name" into the local topic and
+the addressed node name, if it is addressed to one of our own names.
+*/
+func (ptr *RemoteEventCollector) SplitTarget(topic string) (key, targetName string, ok bool) {
+	for _, name := range ptr.OwnNames {
+		if events.Match("*@"+name, topic) {
+			return strings.TrimSuffix(topic, "@"+name), name, true
+		}
+	}
+	return "", "", false
+}
+
 func (ptr *RemoteEventCollector) ConnectToHost(addr string) {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -74,10 +94,18 @@ func (ptr *RemoteEventCollector) ConnectToHost(addr string) {
 	}
 	go ptr.HandleAwnsers(conn, addr)
 	encoder := json.NewEncoder(conn)
+	ptr.offsetsLock.Lock()
+	lastOffset := ptr.offsets[addr]
+	ptr.offsetsLock.Unlock()
 	for _, name := range ptr.OwnNames {
 		msg := new(apiserver.ApiMessage)
 		msg.Type = "subscribe"
 		msg.Key = "*@" + name
+		if lastOffset > 0 {
+			msg.Payload = map[string]interface{}{
+				"offset": lastOffset + 1,
+			}
+		}
 		err = encoder.Encode(msg)
 		if err != nil {
 			return
@@ -102,12 +130,21 @@ func (ptr *RemoteEventCollector) HandleAwnsers(conn net.Conn, addr string) {
 			}
 		case "event":
 			{
-				parts := strings.Split(msg.Key, "@")
-				key := parts[0]
-				targetName := parts[1]
+				key, targetName, ok := ptr.SplitTarget(msg.Key)
+				if !ok {
+					continue
+				}
+				if msg.Offset > 0 {
+					ptr.offsetsLock.Lock()
+					ptr.offsets[addr] = msg.Offset
+					ptr.offsetsLock.Unlock()
+				}
 				event := events.NewEvent(key, msg.Payload)
 				event.AuthLevel = msg.AuthLevel
 				event.ReturnAddr = msg.ReturnAddr
+				//continue the trace of the remote event
+				event.TraceId = msg.TraceId
+				event.ParentId = msg.EventId
 				if payload, ok := msg.Payload.(map[string]interface{}); ok {
 					payload["targetName"] = targetName
 					event.Payload = payload
@@ -0,0 +1,235 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+ACLs restrict who may publish and subscribe to which topics, on top of the
+authlevel of the events. The rules are checked in order, and the first rule
+whose topic pattern matches and which has a grant for the action decides.
+Topics without such a rule are open to everybody. In the config (events.cfg):
+	{"acl": [
+		{"topic": "session::#", "publish": {"authlevel": 0}, "subscribe": {"authlevel": 1, "users": ["monitor"]}},
+		{"topic": "firebird::*", "subscribe": {"users": ["accounting"]}}
+	]}
+A grant admits the listed users and all authlevels up to its authlevel.
+Authlevel 0 is the server itself and is always admitted.
+Subscriptions to patterns are checked for every topic they would receive.
+Besides the ACL, publishers need the permission events:publish:<topic> and
+subscribers events:subscribe:<topic> (see package permissions). Packages can
+require further permissions from the subscribers of their topics with
+RequirePermission, e.g. the state requires state:read:<key> for its change events.
+*/
+
+import (
+	"encoding/json"
+	"github.com/trusch/susi/permissions"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type ACLGrant struct {
+	AuthLevel uint8    `json:"authlevel"`
+	Users     []string `json:"users"`
+}
+
+type ACLRule struct {
+	Topic     string    `json:"topic"`
+	Publish   *ACLGrant `json:"publish"`
+	Subscribe *ACLGrant `json:"subscribe"`
+}
+
+/*
+Returned by TryPublish and TrySubscribe if the ACL forbids the action.
+*/
+type AccessDeniedError struct {
+	Action string
+	Topic  string
+}
+
+func (err *AccessDeniedError) Error() string {
+	return "not allowed to " + err.Action + " " + err.Topic
+}
+
+var aclRules atomic.Value
+
+type topicPermission struct {
+	Prefix string
+	Domain string
+	Action string
+}
+
+var topicPermissions struct {
+	sync.Mutex
+	list atomic.Value //[]*topicPermission
+	//counts the calls of RequirePermission
+	version uint64
+}
+
+/*
+permitVersion identifies the permissions a cached decision was made with.
+*/
+type permitVersion struct {
+	permissions uint64
+	topics      uint64
+}
+
+// a subscription forgets its cached decisions once it has this many
+const MAX_CACHED_PERMITS = 1024
+
+/*
+RequirePermission makes subscribers of all topics starting with prefix also
+need the permission domain:action:<the rest of the topic>.
+*/
+func RequirePermission(prefix, domain, action string) {
+	topicPermissions.Lock()
+	defer topicPermissions.Unlock()
+	old, _ := topicPermissions.list.Load().([]*topicPermission)
+	list := make([]*topicPermission, 0, len(old)+1)
+	for _, required := range old {
+		if required.Prefix != prefix || required.Domain != domain || required.Action != action {
+			list = append(list, required)
+		}
+	}
+	topicPermissions.list.Store(append(list, &topicPermission{prefix, domain, action}))
+	atomic.AddUint64(&topicPermissions.version, 1)
+}
+
+/*
+maySubscribe checks the permissions of roles (or of authlevel, if roles is
+empty) to receive events of topic.
+*/
+func maySubscribe(topic string, roles []string, authlevel uint8) bool {
+	if !permissions.Check(roles, authlevel, permissions.EVENTS, permissions.SUBSCRIBE, topic) {
+		return false
+	}
+	list, _ := topicPermissions.list.Load().([]*topicPermission)
+	for _, required := range list {
+		if strings.HasPrefix(topic, required.Prefix) &&
+			!permissions.Check(roles, authlevel, required.Domain, required.Action, topic[len(required.Prefix):]) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+mayReceive is maySubscribe for the roles and authlevel of the subscription.
+The decision is cached per topic until the permissions change, so deliveries
+do not match the permissions of every subscriber over and over.
+*/
+func (sub *subscription) mayReceive(topic string) bool {
+	version := permitVersion{permissions.Version(), atomic.LoadUint64(&topicPermissions.version)}
+	sub.permitLock.Lock()
+	defer sub.permitLock.Unlock()
+	if sub.permitted == nil || sub.permitVersion != version || len(sub.permitted) >= MAX_CACHED_PERMITS {
+		sub.permitted = make(map[string]bool)
+		sub.permitVersion = version
+	}
+	allowed, ok := sub.permitted[topic]
+	if !ok {
+		allowed = maySubscribe(topic, sub.Roles, sub.AuthLevel)
+		sub.permitted[topic] = allowed
+	}
+	return allowed
+}
+
+/*
+SetACL replaces all rules, nil opens all topics again.
+*/
+func SetACL(rules []*ACLRule) {
+	aclRules.Store(rules)
+}
+
+/*
+LoadACL sets the rules from their config representation, usually
+state.Get("events.acl"). A nil config clears the rules.
+*/
+func LoadACL(config interface{}) error {
+	if config == nil {
+		SetACL(nil)
+		return nil
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var rules []*ACLRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	SetACL(rules)
+	return nil
+}
+
+/*
+CanPublish checks the ACL and the permissions of roles (or of authlevel, if
+roles is empty).
+*/
+func CanPublish(topic, username string, roles []string, authlevel uint8) bool {
+	return publishGrant(topic).admits(username, authlevel) &&
+		permissions.Check(roles, authlevel, permissions.EVENTS, permissions.PUBLISH, topic)
+}
+
+func CanSubscribe(topic, username string, roles []string, authlevel uint8) bool {
+	return subscribeGrant(topic).admits(username, authlevel) && maySubscribe(topic, roles, authlevel)
+}
+
+func publishGrant(topic string) *ACLGrant {
+	rules, _ := aclRules.Load().([]*ACLRule)
+	for _, rule := range rules {
+		if rule.Publish != nil && Match(rule.Topic, topic) {
+			return rule.Publish
+		}
+	}
+	return nil
+}
+
+func subscribeGrant(topic string) *ACLGrant {
+	rules, _ := aclRules.Load().([]*ACLRule)
+	for _, rule := range rules {
+		if rule.Subscribe != nil && Match(rule.Topic, topic) {
+			return rule.Subscribe
+		}
+	}
+	return nil
+}
+
+/*
+A nil grant means no rule applies.
+*/
+func (grant *ACLGrant) admits(username string, authlevel uint8) bool {
+	if grant == nil || authlevel <= grant.AuthLevel {
+		return true
+	}
+	if username == "" {
+		return false
+	}
+	for _, user := range grant.Users {
+		if user == username {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+permits tells whether the subscription may see the event. Glob, wildcard and
+plain subscriptions are checked the same way: the authlevel of the event must
+admit the subscription and so must grant, the subscribe grant for the topic
+of the event, and the roles of the subscription must allow subscribing to it
+(including the permissions required by RequirePermission).
+*/
+func (sub *subscription) permits(event *Event, grant *ACLGrant) bool {
+	return sub.AuthLevel <= event.AuthLevel && grant.admits(sub.Username, sub.AuthLevel) &&
+		sub.mayReceive(event.Topic)
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"github.com/trusch/susi/permissions"
+	"strconv"
+	"testing"
+)
+
+func TestGlobSubscriptionAuthLevel(t *testing.T) {
+	ch, closeChan := Subscribe("acl::glob::*", 3)
+	defer func() { closeChan <- true }()
+	secret := NewEvent("acl::glob::secret", nil)
+	secret.AuthLevel = 1
+	if err := TryPublish(secret); err == nil {
+		t.Error("a glob subscription with authlevel 3 must not receive events of authlevel 1")
+	}
+	public := NewEvent("acl::glob::public", nil)
+	public.AuthLevel = 3
+	if err := TryPublish(public); err != nil {
+		t.Error(err)
+	}
+	if len(ch) != 1 || (<-ch).Topic != "acl::glob::public" {
+		t.Error("expected exactly the public event")
+	}
+}
+
+func TestACL(t *testing.T) {
+	err := LoadACL([]interface{}{
+		map[string]interface{}{
+			"topic":     "acl::locked::*",
+			"publish":   map[string]interface{}{"authlevel": 1, "users": []interface{}{"writer"}},
+			"subscribe": map[string]interface{}{"authlevel": 1, "users": []interface{}{"reader"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetACL(nil)
+
+	if _, _, err := TrySubscribe("acl::locked::door", 5, SubscribeOptions{Username: "guest"}); err == nil {
+		t.Error("expected guests to be denied")
+	}
+	readerChan, readerClose, err := TrySubscribe("acl::locked::door", 5, SubscribeOptions{Username: "reader"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { readerClose <- true }()
+	globChan, globClose := SubscribeWithOptions("acl::*", 5, SubscribeOptions{Username: "guest"})
+	defer func() { globClose <- true }()
+
+	event := NewEvent("acl::locked::door", nil)
+	event.Username = "guest"
+	if _, ok := TryPublish(event).(*AccessDeniedError); !ok {
+		t.Error("expected guests not to publish")
+	}
+	event = NewEvent("acl::locked::door", nil)
+	event.Username = "writer"
+	if err := TryPublish(event); err != nil {
+		t.Error(err)
+	}
+	if len(readerChan) != 1 {
+		t.Error("expected the reader to get the event")
+	}
+	if len(globChan) != 0 {
+		t.Error("the ACL must apply to glob subscriptions too")
+	}
+	if !CanPublish("acl::open", "", nil, 255) {
+		t.Error("topics without rules are open")
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	permissions.DefineRole("acl-reader", "events:subscribe:acl::roles::*")
+	defer permissions.Reset()
+	if _, _, err := TrySubscribe("acl::other", 5, SubscribeOptions{Roles: []string{"acl-reader"}}); err == nil {
+		t.Error("expected the role to be limited to acl::roles::*")
+	}
+	ch, closeChan := SubscribeWithOptions("acl::*", 5, SubscribeOptions{Roles: []string{"acl-reader"}})
+	defer func() { closeChan <- true }()
+	Publish(NewEvent("acl::roles::a", nil))
+	Publish(NewEvent("acl::secret", nil))
+	if len(ch) != 1 || (<-ch).Topic != "acl::roles::a" {
+		t.Error("expected only the permitted event")
+	}
+	//patterns are checked per event, like TrySubscribe does
+	if CheckSubscribe("acl::*", "", []string{"acl-reader"}, 5) != nil || CheckSubscribe("acl::other", "", []string{"acl-reader"}, 5) == nil {
+		t.Error("expected plain topics to be checked up front and patterns to be accepted")
+	}
+	event := NewEvent("acl::roles::a", nil)
+	event.Roles = []string{"acl-reader"}
+	if _, ok := TryPublish(event).(*AccessDeniedError); !ok {
+		t.Error("the role must not publish")
+	}
+}
+
+func TestACLAfterInterception(t *testing.T) {
+	SetACL([]*ACLRule{{Topic: "acl::admin::#", Publish: &ACLGrant{AuthLevel: 0}}})
+	defer SetACL(nil)
+	RegisterInterceptor("reroute", func(event *Event) error {
+		if event.Topic == "acl::public" {
+			event.Topic = "acl::admin::reboot"
+		}
+		return nil
+	})
+	defer UnregisterInterceptor("reroute")
+	ch, closeChan := Subscribe("acl::admin::reboot", 0)
+	defer func() { closeChan <- true }()
+	if _, ok := TryPublish(NewEvent("acl::public", nil)).(*AccessDeniedError); !ok {
+		t.Error("expected the rerouted event to be checked against the ACL of its new topic")
+	}
+	if len(ch) != 0 {
+		t.Error("the rerouted event must not be delivered")
+	}
+}
+
+func TestPermitsFollowRoleChanges(t *testing.T) {
+	//required permissions can not be removed, so every run gets its own topics
+	prefix := "acl::cached" + strconv.FormatUint(NextId(), 10) + "::"
+	permissions.DefineRole("acl-cached", "events:subscribe:"+prefix+"a")
+	defer permissions.RemoveRole("acl-cached")
+	ch, closeChan := SubscribeWithOptions(prefix+"*", 5, SubscribeOptions{Roles: []string{"acl-cached"}})
+	defer func() { closeChan <- true }()
+	Publish(NewEvent(prefix+"b", nil))
+	if len(ch) != 0 {
+		t.Fatal("expected the event to be denied")
+	}
+	//the cached decision is dropped once the role changes
+	permissions.DefineRole("acl-cached", "events:subscribe:"+prefix+"*")
+	Publish(NewEvent(prefix+"b", nil))
+	if len(ch) != 1 {
+		t.Error("expected the event to be delivered after the role was extended")
+	}
+	RequirePermission(prefix, permissions.STATE, permissions.READ)
+	Publish(NewEvent(prefix+"b", nil))
+	if len(ch) != 1 {
+		t.Error("expected the required permission to apply to the cached subscription")
+	}
+}
@@ -11,24 +11,96 @@
 
 package events
 
-func Awnser(requestEvent *Event, data interface{}) {
-	if requestEvent.ReturnAddr != "" {
-		event := NewEvent(requestEvent.ReturnAddr, map[string]interface{}{
-			"error": false,
-			"data":  data,
-		})
-		event.AuthLevel = requestEvent.AuthLevel
-		Publish(event)
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+The name this node uses as responder in awnsers. It defaults to the hostname.
+*/
+var Identity string
+
+/*
+ResponderName qualifies the name of a subscriber (an engine, a session) with
+the Identity of this node, so RequestAll can tell apart all awnsers of a node.
+*/
+func ResponderName(name string) string {
+	if name == "" {
+		return Identity
 	}
+	return name + "@" + Identity
+}
+
+/*
+isAwnserTopic reports whether topic is the awnser topic of a request, the
+AWNSER_TOPIC_PREFIX followed by the request id.
+*/
+func isAwnserTopic(topic string) bool {
+	if !strings.HasPrefix(topic, AWNSER_TOPIC_PREFIX) {
+		return false
+	}
+	_, err := strconv.ParseUint(topic[len(AWNSER_TOPIC_PREFIX):], 10, 64)
+	return err == nil
+}
+
+/*
+MarkResponder adds the responder to an awnser published by name, unless it
+already names one. Awnsers of clients and js controllers are published as
+plain events, so the apiserver and the js engine mark them. The payload is
+copied, the publisher may still use its map.
+*/
+func MarkResponder(event *Event, name string) {
+	if !isAwnserTopic(event.Topic) {
+		return
+	}
+	data, ok := event.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if _, ok := data["responder"]; ok {
+		return
+	}
+	marked := make(map[string]interface{}, len(data)+1)
+	for key, value := range data {
+		marked[key] = value
+	}
+	marked["responder"] = ResponderName(name)
+	event.Payload = marked
+}
+
+func Awnser(requestEvent *Event, data interface{}) {
+	AwnserAs("", requestEvent, data)
 }
 
 func AwnserError(requestEvent *Event, message string) {
+	AwnserErrorAs("", requestEvent, message)
+}
+
+/*
+AwnserAs awnsers in the name of a subscriber, see ResponderName.
+*/
+func AwnserAs(responder string, requestEvent *Event, data interface{}) {
+	awnser(requestEvent, map[string]interface{}{
+		"error":     false,
+		"data":      data,
+		"responder": ResponderName(responder),
+	})
+}
+
+func AwnserErrorAs(responder string, requestEvent *Event, message string) {
+	awnser(requestEvent, map[string]interface{}{
+		"error":     true,
+		"data":      message,
+		"responder": ResponderName(responder),
+	})
+}
+
+func awnser(requestEvent *Event, payload map[string]interface{}) {
 	if requestEvent.ReturnAddr != "" {
-		event := NewEvent(requestEvent.ReturnAddr, map[string]interface{}{
-			"error": true,
-			"data":  message,
-		})
+		event := NewChildEvent(requestEvent, requestEvent.ReturnAddr, payload)
 		event.AuthLevel = requestEvent.AuthLevel
+		event.Priority = requestEvent.Priority
 		Publish(event)
 	}
 }
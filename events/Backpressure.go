@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"errors"
+	"log"
+)
+
+/*
+A BackpressurePolicy decides what happens when the event channel of a
+subscription is full while the event system tries to deliver an event.
+*/
+type BackpressurePolicy uint8
+
+const (
+	BLOCK BackpressurePolicy = iota
+	DROP_NEWEST
+	DROP_OLDEST
+	DISCONNECT
+)
+
+const DROPPED_TOPIC = "system::events::dropped"
+
+var policyNames = map[BackpressurePolicy]string{
+	BLOCK:       "block",
+	DROP_NEWEST: "drop-newest",
+	DROP_OLDEST: "drop-oldest",
+	DISCONNECT:  "disconnect",
+}
+
+func (policy BackpressurePolicy) String() string {
+	return policyNames[policy]
+}
+
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	for policy, policyName := range policyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return BLOCK, errors.New("no such backpressure policy: " + name)
+}
+
+/*
+While a subscription replays the journal, new events are kept back in its
+backlog, so they are delivered after the replayed ones.
+*/
+const MAX_BACKLOG = 1000
+
+func (eventSystem *EventSystem) deliver(sub *subscription, event *Event) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if sub.closed {
+		return
+	}
+	if sub.backlog != nil {
+		if len(sub.backlog) >= MAX_BACKLOG {
+			sub.backlog = sub.backlog[1:]
+			eventSystem.drop(sub.Topic)
+		}
+		sub.backlog = append(sub.backlog, event)
+		return
+	}
+	eventSystem.deliverNow(sub, event)
+}
+
+/*
+deliverNow must be called with the lock of the subscription held and the
+subscription not closed. A blocking delivery releases the lock while it waits
+for the channel and holds it again on return, so callers check closed again
+afterwards. The send counts as in flight until then, and close waits for it
+before it closes the channel; it gives up once done is closed.
+*/
+func (eventSystem *EventSystem) deliverNow(sub *subscription, event *Event) {
+	switch sub.Policy {
+	case DROP_NEWEST:
+		{
+			select {
+			case sub.EventChan <- event:
+			default:
+				eventSystem.drop(sub.Topic)
+			}
+		}
+	case DROP_OLDEST:
+		{
+			for {
+				select {
+				case sub.EventChan <- event:
+					return
+				default:
+				}
+				select {
+				case <-sub.EventChan:
+					eventSystem.drop(sub.Topic)
+				default:
+				}
+			}
+		}
+	case DISCONNECT:
+		{
+			select {
+			case sub.EventChan <- event:
+			default:
+				log.Printf("disconnecting subscription to %v (%v): event channel overflow", sub.Topic, sub.Id)
+				eventSystem.drop(sub.Topic)
+				sub.signalDone()
+				sub.closed = true
+				close(sub.EventChan)
+				go eventSystem.unsubscribe(sub.Topic, sub.Id)
+			}
+		}
+	default:
+		{
+			select {
+			case sub.EventChan <- event:
+				return
+			default:
+			}
+			sub.sending.Add(1)
+			sub.lock.Unlock()
+			select {
+			case sub.EventChan <- event:
+			case <-sub.done:
+			}
+			sub.sending.Done()
+			sub.lock.Lock()
+		}
+	}
+}
+
+func (eventSystem *EventSystem) droppedCounters() map[string]uint64 {
+	eventSystem.droppedLock.Lock()
+	defer eventSystem.droppedLock.Unlock()
+	counters := make(map[string]uint64, len(eventSystem.dropped))
+	for topic, count := range eventSystem.dropped {
+		counters[topic] = count
+	}
+	return counters
+}
+
+/*
+Answers requests on DROPPED_TOPIC with the number of dropped events per subscribed topic.
+*/
+func serveDroppedCounters(ch chan *Event) {
+	for event := range ch {
+		Awnser(event, eventSystem.droppedCounters())
+	}
+}
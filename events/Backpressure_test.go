@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+	Go()
+}
+
+func TestBackpressurePolicies(t *testing.T) {
+	//the dropped counters outlive the test, so every run needs its own topic
+	topic := "backpressure::" + strconv.FormatUint(NextId(), 10)
+	newest, closeNewest := SubscribeWithOptions(topic, 0, SubscribeOptions{Policy: DROP_NEWEST})
+	oldest, closeOldest := SubscribeWithOptions(topic, 0, SubscribeOptions{Policy: DROP_OLDEST})
+	disconnect, _ := SubscribeWithOptions(topic, 0, SubscribeOptions{Policy: DISCONNECT})
+	defer func() {
+		closeNewest <- true
+		closeOldest <- true
+	}()
+
+	for i := 0; i < 150; i++ {
+		Publish(NewEvent(topic, i))
+	}
+
+	if event := <-newest; event.Payload.(int) != 0 {
+		t.Errorf("drop-newest: expected first event to be 0, got %v", event.Payload)
+	}
+	if event := <-oldest; event.Payload.(int) != 50 {
+		t.Errorf("drop-oldest: expected first event to be 50, got %v", event.Payload)
+	}
+	count := 0
+	for _ = range disconnect {
+		count++
+	}
+	if count != 100 {
+		t.Errorf("disconnect: expected 100 events before disconnect, got %v", count)
+	}
+
+	counters, err := Request(DROPPED_TOPIC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped := counters.(map[string]uint64)[topic]; dropped != 50+50+1 {
+		t.Errorf("expected 101 dropped events, got %v", dropped)
+	}
+}
+
+func TestCloseBlockedSubscriber(t *testing.T) {
+	topic := "backpressure::block" + strconv.FormatUint(NextId(), 10)
+	blocked, closeBlocked := SubscribeWithOptions(topic, 0, SubscribeOptions{Policy: BLOCK})
+	for i := 0; i < cap(blocked); i++ {
+		Publish(NewEvent(topic, i))
+	}
+	//the channel is full, so this publish stalls the dispatcher of the topic
+	published := make(chan bool)
+	go func() {
+		Publish(NewEvent(topic, "stalled"))
+		published <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	closeBlocked <- true
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("closing a blocked subscriber deadlocked the dispatcher")
+	}
+	for _ = range blocked {
+	}
+	ch, closeChan := Subscribe(topic, 0)
+	defer func() { closeChan <- true }()
+	Publish(NewEvent(topic, "after"))
+	select {
+	case event := <-ch:
+		if event.Payload != "after" {
+			t.Errorf("unexpected event %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Error("the dispatcher did not recover")
+	}
+}
+
+func TestBlockedDeliveryReleasesLock(t *testing.T) {
+	topic := "backpressure::lock" + strconv.FormatUint(NextId(), 10)
+	blocked, closeBlocked := SubscribeWithOptions(topic, 0, SubscribeOptions{Policy: BLOCK})
+	defer func() { closeBlocked <- true }()
+	sub := eventSystem.shardFor(topic).current()[topic][0]
+	for i := 0; i < cap(blocked); i++ {
+		Publish(NewEvent(topic, i))
+	}
+	published := make(chan bool)
+	go func() {
+		Publish(NewEvent(topic, "stalled"))
+		published <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	locked := make(chan bool)
+	go func() {
+		sub.lock.Lock()
+		sub.lock.Unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("a blocked delivery holds the lock of the subscription")
+	}
+	<-blocked
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("the blocked delivery did not resume")
+	}
+	for i := 1; i < cap(blocked); i++ {
+		<-blocked
+	}
+	if event := <-blocked; event.Payload != "stalled" {
+		t.Errorf("expected the stalled event last, got %v", event.Payload)
+	}
+}
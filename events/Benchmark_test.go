@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+Compares the sharded event system with the former single goroutine design,
+which is kept here as legacyBus. Run with:
+	go test -run NONE -bench . -cpu 1,4,8 ./events
+*/
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+type bus interface {
+	subscribe(topic string) (chan *Event, chan bool)
+	publish(event *Event) bool
+}
+
+const (
+	LEGACY_SUBSCRIBE = iota
+	LEGACY_UNSUBSCRIBE
+	LEGACY_PUBLISH
+)
+
+type legacyCommand struct {
+	Type   int
+	Topic  string
+	Id     uint64
+	Event  *Event
+	Result chan interface{}
+}
+
+/*
+legacyBus serializes every subscribe, unsubscribe and publish through one
+goroutine, which also does the fan-out.
+*/
+type legacyBus struct {
+	cmdChan   chan *legacyCommand
+	topics    map[string]map[uint64]chan *Event
+	wildcards *topicTrie
+}
+
+func newLegacyBus() *legacyBus {
+	bus := &legacyBus{
+		cmdChan:   make(chan *legacyCommand, 10),
+		topics:    make(map[string]map[uint64]chan *Event),
+		wildcards: newTopicTrie(),
+	}
+	go func() {
+		for cmd := range bus.cmdChan {
+			switch cmd.Type {
+			case LEGACY_SUBSCRIBE:
+				{
+					ch := make(chan *Event, 100)
+					id := NextId()
+					if isWildcard(cmd.Topic) {
+						bus.wildcards.insert(cmd.Topic, id, &subscription{Id: id, EventChan: ch})
+					} else {
+						if bus.topics[cmd.Topic] == nil {
+							bus.topics[cmd.Topic] = make(map[uint64]chan *Event)
+						}
+						bus.topics[cmd.Topic][id] = ch
+					}
+					cmd.Result <- &subscription{Id: id, EventChan: ch}
+				}
+			case LEGACY_UNSUBSCRIBE:
+				{
+					if isWildcard(cmd.Topic) {
+						if sub := bus.wildcards.remove(cmd.Topic, cmd.Id); sub != nil {
+							close(sub.EventChan)
+						}
+					} else if ch, ok := bus.topics[cmd.Topic][cmd.Id]; ok {
+						delete(bus.topics[cmd.Topic], cmd.Id)
+						close(ch)
+					}
+				}
+			case LEGACY_PUBLISH:
+				{
+					found := false
+					for _, sub := range bus.wildcards.match(cmd.Event.Topic) {
+						sub.EventChan <- cmd.Event
+						found = true
+					}
+					for _, ch := range bus.topics[cmd.Event.Topic] {
+						ch <- cmd.Event
+						found = true
+					}
+					cmd.Result <- found
+				}
+			}
+		}
+	}()
+	return bus
+}
+
+func (bus *legacyBus) subscribe(topic string) (chan *Event, chan bool) {
+	cmd := &legacyCommand{Type: LEGACY_SUBSCRIBE, Topic: topic, Result: make(chan interface{})}
+	bus.cmdChan <- cmd
+	sub := (<-cmd.Result).(*subscription)
+	closeChan := make(chan bool)
+	go func() {
+		<-closeChan
+		bus.cmdChan <- &legacyCommand{Type: LEGACY_UNSUBSCRIBE, Topic: topic, Id: sub.Id}
+	}()
+	return sub.EventChan, closeChan
+}
+
+func (bus *legacyBus) publish(event *Event) bool {
+	payload, err := DecodePayload(event.Topic, event.Payload)
+	if err != nil {
+		return false
+	}
+	event.Payload = payload
+	if err := intercept(event); err != nil {
+		return false
+	}
+	cmd := &legacyCommand{Type: LEGACY_PUBLISH, Event: event, Result: make(chan interface{})}
+	bus.cmdChan <- cmd
+	return (<-cmd.Result).(bool)
+}
+
+type shardedBus struct{}
+
+func (shardedBus) subscribe(topic string) (chan *Event, chan bool) {
+	return Subscribe(topic, 0)
+}
+
+func (shardedBus) publish(event *Event) bool {
+	return Publish(event)
+}
+
+/*
+benchmarkBus subscribes subscribers times to each of the topics, drains all
+subscriptions and publishes round robin to the topics from parallel goroutines.
+*/
+func benchmarkBus(b *testing.B, bus bus, topics, subscribers int) {
+	names := make([]string, topics)
+	closeChans := make([]chan bool, 0, topics*subscribers)
+	for i := range names {
+		names[i] = "bench::" + strconv.Itoa(i)
+		for j := 0; j < subscribers; j++ {
+			eventChan, closeChan := bus.subscribe(names[i])
+			closeChans = append(closeChans, closeChan)
+			go func() {
+				for _ = range eventChan {
+				}
+			}()
+		}
+	}
+	defer func() {
+		for _, closeChan := range closeChans {
+			closeChan <- true
+		}
+	}()
+	var counter uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&counter, 1)
+			bus.publish(NewEvent(names[i%uint64(topics)], i))
+		}
+	})
+}
+
+func BenchmarkLegacyManyTopics(b *testing.B) {
+	benchmarkBus(b, newLegacyBus(), 1000, 1)
+}
+
+func BenchmarkShardedManyTopics(b *testing.B) {
+	benchmarkBus(b, shardedBus{}, 1000, 1)
+}
+
+func BenchmarkLegacyManySubscribers(b *testing.B) {
+	benchmarkBus(b, newLegacyBus(), 1, 100)
+}
+
+func BenchmarkShardedManySubscribers(b *testing.B) {
+	benchmarkBus(b, shardedBus{}, 1, 100)
+}
+
+func BenchmarkLegacyManyTopicsAndSubscribers(b *testing.B) {
+	benchmarkBus(b, newLegacyBus(), 100, 10)
+}
+
+func BenchmarkShardedManyTopicsAndSubscribers(b *testing.B) {
+	benchmarkBus(b, shardedBus{}, 100, 10)
+}
@@ -0,0 +1,410 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+A durable consumer is a named subscription which outlives the channel reading
+from it. Events are queued while nobody is attached, and every delivered
+event stays in flight until it is acked. Nacked events and events which are
+not acked within the redelivery timeout are delivered again, until MaxAttempts
+is reached and the event is dead lettered. Publishers can safely retry with
+the same DedupeId: events whose user already published the DedupeId (or
+events with an id the consumer has already seen) are dropped. With
+events.consumers.dir the pending events are kept on disk (see ConsumerStore.go).
+A consumer subscribes with DROP_NEWEST, so a consumer which can not keep up
+loses events (counted as dropped) instead of stalling the event system.
+*/
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DEADLETTER_ATTEMPTS = "max attempts"
+	DEADLETTER_OVERFLOW = "overflow"
+)
+
+type ConsumerOptions struct {
+	//how long an event may stay unacked (default 30s)
+	Redelivery time.Duration
+	//how often an event is delivered before it is dead lettered (default 5)
+	MaxAttempts int
+	//how many events may be unacked at once (default 100)
+	MaxInflight int
+	//how many events are queued while nobody is attached (default 10000)
+	MaxQueue int
+	//how long ids are remembered for deduplication (default 10m)
+	DedupeWindow time.Duration
+	//the user the ACL grants are checked for
+	Username string
+	//the roles permissions are checked for
+	Roles []string
+}
+
+func (options *ConsumerOptions) setDefaults() {
+	if options.Redelivery <= 0 {
+		options.Redelivery = 30 * time.Second
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = 5
+	}
+	if options.MaxInflight <= 0 {
+		options.MaxInflight = 100
+	}
+	if options.MaxQueue <= 0 {
+		options.MaxQueue = 10000
+	}
+	if options.DedupeWindow <= 0 {
+		options.DedupeWindow = 10 * time.Minute
+	}
+}
+
+type inflightEvent struct {
+	Event    *Event
+	Attempts int
+	Deadline time.Time
+}
+
+type consumer struct {
+	Name      string
+	Topic     string
+	AuthLevel uint8
+	options   ConsumerOptions
+	lock      sync.Mutex
+	queue     []*inflightEvent
+	inflight  map[uint64]*inflightEvent
+	seen      map[string]time.Time
+	out       chan *Event
+	closeChan chan bool
+	done      chan bool
+	//nil if the consumer is kept in memory only
+	log *consumerLog
+}
+
+var consumers = struct {
+	sync.Mutex
+	byName map[string]*consumer
+}{byName: make(map[string]*consumer)}
+
+/*
+Consume attaches to the durable consumer name, creating it if needed. Only
+one channel can be attached to a consumer at a time. Closing closeChannel
+detaches, and all events in flight are delivered again to the next attachment.
+*/
+func Consume(name, topic string, authlevel uint8, options ConsumerOptions) (eventChannel chan *Event, closeChannel chan bool, err error) {
+	cons, err := declareConsumer(name, topic, authlevel, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cons.attach()
+}
+
+/*
+DeclareConsumer creates the durable consumer name without attaching to it, so
+it queues the events of topic before anybody consumes them. Declaring an
+existing consumer does nothing.
+*/
+func DeclareConsumer(name, topic string, authlevel uint8, options ConsumerOptions) error {
+	_, err := declareConsumer(name, topic, authlevel, options)
+	return err
+}
+
+func declareConsumer(name, topic string, authlevel uint8, options ConsumerOptions) (*consumer, error) {
+	if CheckSubscribe(topic, options.Username, options.Roles, authlevel) != nil {
+		return nil, &AccessDeniedError{"consume", topic}
+	}
+	consumers.Lock()
+	defer consumers.Unlock()
+	cons, ok := consumers.byName[name]
+	if !ok {
+		log, err := createConsumerLog(&consumerDefinition{name, topic, authlevel, options})
+		if err != nil {
+			return nil, err
+		}
+		cons = newConsumer(name, topic, authlevel, options, log, nil, nil)
+		consumers.byName[name] = cons
+	} else if cons.Topic != topic {
+		return nil, errors.New("consumer " + name + " consumes " + cons.Topic)
+	} else if authlevel > cons.AuthLevel {
+		return nil, errors.New("authlevel too low for consumer " + name)
+	}
+	return cons, nil
+}
+
+/*
+Ack confirms that the event was handled.
+*/
+func Ack(name string, eventId uint64) bool {
+	if cons := consumerByName(name); cons != nil {
+		return cons.ack(eventId)
+	}
+	return false
+}
+
+/*
+Nack hands the event back for immediate redelivery.
+*/
+func Nack(name string, eventId uint64) bool {
+	if cons := consumerByName(name); cons != nil {
+		return cons.nack(eventId)
+	}
+	return false
+}
+
+/*
+DeleteConsumer detaches and forgets the consumer with all its pending events.
+*/
+func DeleteConsumer(name string) bool {
+	consumers.Lock()
+	cons, ok := consumers.byName[name]
+	delete(consumers.byName, name)
+	consumers.Unlock()
+	if ok {
+		cons.lock.Lock()
+		if cons.out != nil {
+			close(cons.out)
+			cons.out = nil
+		}
+		if cons.log != nil {
+			cons.log.close(true)
+			cons.log = nil
+		}
+		cons.lock.Unlock()
+		close(cons.done)
+		cons.closeChan <- true
+	}
+	return ok
+}
+
+func consumerByName(name string) *consumer {
+	consumers.Lock()
+	defer consumers.Unlock()
+	return consumers.byName[name]
+}
+
+/*
+newConsumer starts a consumer with the events and dedupe keys restored from its log.
+*/
+func newConsumer(name, topic string, authlevel uint8, options ConsumerOptions, log *consumerLog, queue []*Event, seen map[string]time.Time) *consumer {
+	options.setDefaults()
+	if seen == nil {
+		seen = make(map[string]time.Time)
+	}
+	cons := &consumer{
+		Name:      name,
+		Topic:     topic,
+		AuthLevel: authlevel,
+		options:   options,
+		inflight:  make(map[uint64]*inflightEvent),
+		seen:      seen,
+		done:      make(chan bool),
+		log:       log,
+	}
+	for _, event := range queue {
+		cons.queue = append(cons.queue, &inflightEvent{Event: event})
+	}
+	//a consumer which falls behind must not stall the dispatcher of its topic
+	var eventChan chan *Event
+	eventChan, cons.closeChan = SubscribeWithOptions(topic, authlevel, SubscribeOptions{
+		Policy:   DROP_NEWEST,
+		Username: options.Username,
+		Roles:    options.Roles,
+	})
+	go func() {
+		for event := range eventChan {
+			cons.enqueue(event)
+		}
+	}()
+	go cons.watch()
+	return cons
+}
+
+func (cons *consumer) attach() (chan *Event, chan bool, error) {
+	cons.lock.Lock()
+	defer cons.lock.Unlock()
+	if cons.out != nil {
+		return nil, nil, errors.New("consumer " + cons.Name + " is already attached")
+	}
+	out := make(chan *Event, cons.options.MaxInflight)
+	closeChan := make(chan bool)
+	cons.out = out
+	cons.pump()
+	go func() {
+		select {
+		case <-closeChan:
+			cons.detach(out)
+		case <-cons.done:
+		}
+	}()
+	return out, closeChan, nil
+}
+
+func (cons *consumer) detach(out chan *Event) {
+	cons.lock.Lock()
+	defer cons.lock.Unlock()
+	if cons.out != out {
+		return
+	}
+	cons.out = nil
+	close(out)
+	for id, inflight := range cons.inflight {
+		delete(cons.inflight, id)
+		cons.requeue(inflight)
+	}
+}
+
+/*
+dedupeKey tells which events are the same: events with a DedupeId are the
+same if their user and DedupeId are, so users can not suppress the events of
+others. Other events are only the same if their server-assigned id is.
+*/
+func dedupeKey(event *Event) string {
+	if event.DedupeId != "" {
+		return "user:" + event.Username + ":" + event.DedupeId
+	}
+	return "id:" + strconv.FormatUint(event.Id, 10)
+}
+
+func (cons *consumer) enqueue(event *Event) {
+	cons.lock.Lock()
+	defer cons.lock.Unlock()
+	key := dedupeKey(event)
+	if _, ok := cons.seen[key]; ok {
+		return
+	}
+	now := time.Now()
+	cons.seen[key] = now
+	if len(cons.queue) >= cons.options.MaxQueue {
+		eventSystem.drop(cons.Topic)
+		go DeadLetter(cons.queue[0].Event, DEADLETTER_OVERFLOW, "queue of consumer "+cons.Name+" is full")
+		cons.finish(cons.queue[0].Event)
+		cons.queue = cons.queue[1:]
+	}
+	if cons.log != nil {
+		cons.log.write(&consumerRecord{Event: event, Key: key, Seen: now.UnixNano()})
+	}
+	cons.queue = append(cons.queue, &inflightEvent{Event: event})
+	cons.pump()
+}
+
+/*
+finish records that event left the consumer for good.
+*/
+func (cons *consumer) finish(event *Event) {
+	if cons.log != nil {
+		cons.log.write(&consumerRecord{Done: event.Id})
+	}
+}
+
+/*
+requeue puts an event back at the front of the queue, or dead letters it
+if it was delivered too often.
+*/
+func (cons *consumer) requeue(inflight *inflightEvent) {
+	if inflight.Attempts >= cons.options.MaxAttempts {
+		go DeadLetter(inflight.Event, DEADLETTER_ATTEMPTS, "consumer "+cons.Name+" did not ack the event")
+		cons.finish(inflight.Event)
+		return
+	}
+	cons.queue = append([]*inflightEvent{inflight}, cons.queue...)
+}
+
+/*
+pump delivers queued events to the attached channel. It must be called with
+the lock of the consumer held and never blocks.
+*/
+func (cons *consumer) pump() {
+	for cons.out != nil && len(cons.queue) > 0 && len(cons.inflight) < cons.options.MaxInflight {
+		next := cons.queue[0]
+		select {
+		case cons.out <- next.Event:
+			{
+				cons.queue = cons.queue[1:]
+				next.Attempts++
+				next.Deadline = time.Now().Add(cons.options.Redelivery)
+				cons.inflight[next.Event.Id] = next
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (cons *consumer) ack(id uint64) bool {
+	cons.lock.Lock()
+	defer cons.lock.Unlock()
+	inflight, ok := cons.inflight[id]
+	if !ok {
+		return false
+	}
+	delete(cons.inflight, id)
+	cons.finish(inflight.Event)
+	cons.pump()
+	return true
+}
+
+func (cons *consumer) nack(id uint64) bool {
+	cons.lock.Lock()
+	defer cons.lock.Unlock()
+	inflight, ok := cons.inflight[id]
+	if !ok {
+		return false
+	}
+	delete(cons.inflight, id)
+	cons.requeue(inflight)
+	cons.pump()
+	return true
+}
+
+/*
+watch redelivers events whose deadline passed, forgets old dedupe keys and
+compacts the log.
+*/
+func (cons *consumer) watch() {
+	interval := cons.options.Redelivery / 2
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			{
+				cons.lock.Lock()
+				for id, inflight := range cons.inflight {
+					if now.After(inflight.Deadline) {
+						delete(cons.inflight, id)
+						cons.requeue(inflight)
+					}
+				}
+				for key, seen := range cons.seen {
+					if now.Sub(seen) > cons.options.DedupeWindow {
+						delete(cons.seen, key)
+					}
+				}
+				if cons.log != nil && cons.log.wasted(len(cons.queue)+len(cons.inflight)+len(cons.seen)) {
+					cons.compact()
+				}
+				cons.pump()
+				cons.lock.Unlock()
+			}
+		case <-cons.done:
+			{
+				return
+			}
+		}
+	}
+}
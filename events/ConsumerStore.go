@@ -0,0 +1,419 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+With events.consumers.dir set, every durable consumer keeps an append-only
+log in that directory: its definition first, then one record per queued
+event (with its dedupe key) and one record per event which was acked, dead
+lettered or dropped. A writer goroutine per log appends the records and
+syncs everything that arrived meanwhile at once, so neither the delivery of
+events nor acks wait for the disk. Pending and unacked events survive a
+restart, a crash loses at most the records of the batch being written. Go()
+restores all consumers of the directory, so they queue events again before
+anybody consumes them.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var consumersDir = flag.String("events.consumers.dir", "", "where durable consumers keep their pending events (empty keeps them in memory only)")
+
+const (
+	CONSUMER_LOG_SUFFIX = ".consumer"
+	//how many stale records a log may collect before it is compacted
+	CONSUMER_LOG_SLACK = 1000
+	//how many commands may wait for the writer of a log
+	CONSUMER_LOG_BACKLOG = 1024
+)
+
+const (
+	LOG_WRITE int = iota
+	LOG_REWRITE
+	LOG_CLOSE
+)
+
+type logCommand struct {
+	Type    int
+	Record  *consumerRecord
+	Records []*consumerRecord
+	//LOG_CLOSE removes the log if set, and closes Done once the log is closed
+	Remove bool
+	Done   chan bool
+}
+
+type consumerDefinition struct {
+	Name      string          `json:"name"`
+	Topic     string          `json:"topic"`
+	AuthLevel uint8           `json:"authlevel"`
+	Options   ConsumerOptions `json:"options"`
+}
+
+type consumerRecord struct {
+	Definition *consumerDefinition `json:"definition,omitempty"`
+	Event      *Event              `json:"event,omitempty"`
+	//dedupe key and when it was seen, recorded with the event or alone after compaction
+	Key  string `json:"key,omitempty"`
+	Seen int64  `json:"seen,omitempty"`
+	//id of an event which left the consumer
+	Done uint64 `json:"done,omitempty,string"`
+}
+
+type consumerLog struct {
+	filename   string
+	definition *consumerDefinition
+	file       *os.File
+	encoder    *json.Encoder
+	commands   chan *logCommand
+	//records the log will hold once the writer is done, guarded by the lock of the consumer
+	records int
+}
+
+/*
+LoadConsumers declares the durable consumers of config (a list of
+{"name","topic","authlevel","options"} objects), so their events are queued
+from the start.
+*/
+func LoadConsumers(config interface{}) error {
+	if config == nil {
+		return nil
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var definitions []*consumerDefinition
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return err
+	}
+	for _, def := range definitions {
+		if err := DeclareConsumer(def.Name, def.Topic, def.AuthLevel, def.Options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func consumerLogFilename(name string) string {
+	return filepath.Join(*consumersDir, url.QueryEscape(name)+CONSUMER_LOG_SUFFIX)
+}
+
+/*
+createConsumerLog starts the log of a new consumer. It returns nil if
+consumers are kept in memory only.
+*/
+func createConsumerLog(definition *consumerDefinition) (*consumerLog, error) {
+	if *consumersDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(*consumersDir, 0755); err != nil {
+		return nil, err
+	}
+	consumerLog := &consumerLog{filename: consumerLogFilename(definition.Name), definition: definition}
+	if err := consumerLog.rewrite(nil); err != nil {
+		return nil, err
+	}
+	consumerLog.records = 1
+	consumerLog.start()
+	return consumerLog, nil
+}
+
+func (consumerLog *consumerLog) start() {
+	consumerLog.commands = make(chan *logCommand, CONSUMER_LOG_BACKLOG)
+	go consumerLog.writer()
+}
+
+/*
+write hands record to the writer. It is called with the lock of the consumer held.
+*/
+func (consumerLog *consumerLog) write(record *consumerRecord) {
+	consumerLog.commands <- &logCommand{Type: LOG_WRITE, Record: record}
+	consumerLog.records++
+}
+
+/*
+replace hands the live records to the writer, which replaces the log by them.
+It is called with the lock of the consumer held.
+*/
+func (consumerLog *consumerLog) replace(records []*consumerRecord) {
+	consumerLog.commands <- &logCommand{Type: LOG_REWRITE, Records: records}
+	consumerLog.records = len(records) + 1
+}
+
+/*
+close waits until the writer wrote all records and closed the log, and
+removes the log if remove is set.
+*/
+func (consumerLog *consumerLog) close(remove bool) {
+	done := make(chan bool)
+	consumerLog.commands <- &logCommand{Type: LOG_CLOSE, Remove: remove, Done: done}
+	<-done
+}
+
+/*
+writer executes the commands of the log. Records which arrive while it
+writes are synced together.
+*/
+func (consumerLog *consumerLog) writer() {
+	for cmd := range consumerLog.commands {
+		unsynced := false
+		for cmd != nil {
+			switch cmd.Type {
+			case LOG_WRITE:
+				{
+					if err := consumerLog.encoder.Encode(cmd.Record); err != nil {
+						log.Print("failed writing consumer log: ", err)
+					}
+					unsynced = true
+				}
+			case LOG_REWRITE:
+				{
+					//the new log is synced, and the records written before are part of it
+					if err := consumerLog.rewrite(cmd.Records); err != nil {
+						log.Print("failed compacting consumer log: ", err)
+					} else {
+						unsynced = false
+					}
+				}
+			case LOG_CLOSE:
+				{
+					if unsynced && !cmd.Remove {
+						consumerLog.sync()
+					}
+					consumerLog.file.Close()
+					if cmd.Remove {
+						consumerLog.remove()
+					}
+					close(cmd.Done)
+					return
+				}
+			}
+			select {
+			case cmd = <-consumerLog.commands:
+			default:
+				cmd = nil
+			}
+		}
+		if unsynced {
+			consumerLog.sync()
+		}
+	}
+}
+
+func (consumerLog *consumerLog) sync() {
+	if err := consumerLog.file.Sync(); err != nil {
+		log.Print("failed syncing consumer log: ", err)
+	}
+}
+
+/*
+wasted tells whether the log holds much more records than the live ones.
+*/
+func (consumerLog *consumerLog) wasted(live int) bool {
+	return consumerLog.records > 2*live+CONSUMER_LOG_SLACK
+}
+
+/*
+rewrite replaces the log by the definition and records, so a crash leaves
+either the old or the new log.
+*/
+func (consumerLog *consumerLog) rewrite(records []*consumerRecord) error {
+	tmp := consumerLog.filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	records = append([]*consumerRecord{{Definition: consumerLog.definition}}, records...)
+	for _, record := range records {
+		if err = encoder.Encode(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, consumerLog.filename)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(consumerLog.filename))
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if consumerLog.file != nil {
+		consumerLog.file.Close()
+	}
+	consumerLog.file = file
+	consumerLog.encoder = encoder
+	return nil
+}
+
+func (consumerLog *consumerLog) remove() {
+	if err := os.Remove(consumerLog.filename); err != nil {
+		log.Print("failed removing consumer log: ", err)
+		return
+	}
+	syncDir(filepath.Dir(consumerLog.filename))
+}
+
+/*
+compact rewrites the log with the pending events and the remembered dedupe
+keys only. It is called with the lock of the consumer held.
+*/
+func (cons *consumer) compact() {
+	records := make([]*consumerRecord, 0, len(cons.seen)+len(cons.inflight)+len(cons.queue))
+	pending := make(map[string]bool)
+	events := make([]*Event, 0, len(cons.inflight)+len(cons.queue))
+	for _, inflight := range cons.inflight {
+		events = append(events, inflight.Event)
+	}
+	for _, queued := range cons.queue {
+		events = append(events, queued.Event)
+	}
+	for _, event := range events {
+		key := dedupeKey(event)
+		pending[key] = true
+		record := &consumerRecord{Event: event, Key: key}
+		if seen, ok := cons.seen[key]; ok {
+			record.Seen = seen.UnixNano()
+		}
+		records = append(records, record)
+	}
+	for key, seen := range cons.seen {
+		if !pending[key] {
+			records = append(records, &consumerRecord{Key: key, Seen: seen.UnixNano()})
+		}
+	}
+	cons.log.replace(records)
+}
+
+/*
+restoreConsumers starts the consumers whose logs are in events.consumers.dir.
+*/
+func restoreConsumers() {
+	if *consumersDir == "" {
+		return
+	}
+	infos, err := ioutil.ReadDir(*consumersDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print("failed restoring consumers: ", err)
+		}
+		return
+	}
+	consumers.Lock()
+	defer consumers.Unlock()
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), CONSUMER_LOG_SUFFIX) {
+			continue
+		}
+		filename := filepath.Join(*consumersDir, info.Name())
+		consumerLog, queue, seen, err := readConsumerLog(filename)
+		if err != nil {
+			log.Printf("failed restoring consumer %v: %v", filename, err)
+			continue
+		}
+		def := consumerLog.definition
+		consumers.byName[def.Name] = newConsumer(def.Name, def.Topic, def.AuthLevel, def.Options, consumerLog, queue, seen)
+		log.Printf("restored consumer %v with %v pending events", def.Name, len(queue))
+	}
+}
+
+/*
+readConsumerLog reads the definition, the pending events and the dedupe keys
+of a log and opens it for appending.
+*/
+func readConsumerLog(filename string) (*consumerLog, []*Event, map[string]time.Time, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	consumerLog := &consumerLog{filename: filename, file: file, encoder: json.NewEncoder(file)}
+	events := make([]*Event, 0)
+	done := make(map[uint64]bool)
+	seen := make(map[string]time.Time)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		record := &consumerRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			//a crash can leave a partial last record
+			log.Printf("skipping broken record in consumer log %v: %v", filename, err)
+			continue
+		}
+		consumerLog.records++
+		switch {
+		case record.Definition != nil:
+			{
+				consumerLog.definition = record.Definition
+			}
+		case record.Done != 0:
+			{
+				done[record.Done] = true
+			}
+		case record.Event != nil:
+			{
+				events = append(events, record.Event)
+			}
+		}
+		if record.Key != "" && record.Seen != 0 {
+			seen[record.Key] = time.Unix(0, record.Seen)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+	if consumerLog.definition == nil {
+		file.Close()
+		return nil, nil, nil, &os.PathError{Op: "restore", Path: filename, Err: os.ErrInvalid}
+	}
+	queue := make([]*Event, 0, len(events))
+	for _, event := range events {
+		if done[event.Id] {
+			continue
+		}
+		//the codecs decoded the payload before it was written as json
+		if payload, err := DecodePayload(event.Topic, event.Payload); err == nil {
+			event.Payload = payload
+		}
+		queue = append(queue, event)
+	}
+	consumerLog.start()
+	return consumerLog, queue, seen, nil
+}
+
+/*
+syncDir makes renames and removals within dir durable.
+*/
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDurableConsumer(t *testing.T) {
+	options := ConsumerOptions{Redelivery: 50 * time.Millisecond, MaxAttempts: 2}
+	ch, closeChan, err := Consume("billing", "consumer::billing", 0, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteConsumer("billing")
+	if _, _, err := Consume("billing", "consumer::billing", 0, options); err == nil {
+		t.Error("expected a second attachment to fail")
+	}
+
+	event := NewEvent("consumer::billing", "invoice")
+	event.Username = "shop"
+	event.DedupeId = "invoice-1"
+	Publish(event)
+	//a retry with the same dedupe id is deduplicated
+	retry := NewEvent("consumer::billing", "invoice")
+	retry.Username = "shop"
+	retry.DedupeId = "invoice-1"
+	Publish(retry)
+
+	first := <-ch
+	if !Nack("billing", first.Id) {
+		t.Fatal("nack failed")
+	}
+	second := <-ch
+	if second.Id != event.Id {
+		t.Fatalf("expected redelivery of %v, got %v", event.Id, second.Id)
+	}
+
+	//the invoice was delivered twice already, so detaching dead letters it
+	EnableDeadLetters(true)
+	defer EnableDeadLetters(false)
+	letters, closeLetters := Subscribe(DEADLETTER_TOPIC, 0)
+	defer func() { closeLetters <- true }()
+	closeChan <- true
+	for _ = range ch {
+	}
+	select {
+	case letter := <-letters:
+		if reason := letter.Payload.(map[string]interface{})["reason"]; reason != DEADLETTER_ATTEMPTS {
+			t.Errorf("unexpected dead letter reason %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the unacked event to be dead lettered")
+	}
+
+	//events are queued while nobody is attached and redelivered until acked
+	Publish(NewEvent("consumer::billing", "queued"))
+	ch, closeChan, err = Consume("billing", "consumer::billing", 0, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { closeChan <- true }()
+	queued := <-ch
+	if redelivered := <-ch; redelivered.Id != queued.Id {
+		t.Errorf("expected redelivery of %v after the timeout, got %v", queued.Id, redelivered.Id)
+	}
+	if !Ack("billing", queued.Id) || Ack("billing", queued.Id) {
+		t.Error("expected exactly one successful ack")
+	}
+	select {
+	case event := <-ch:
+		t.Errorf("unexpected delivery after ack: %v", event)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestConsumerDedupeScope(t *testing.T) {
+	ch, closeChan, err := Consume("dedupe", "consumer::dedupe", 0, ConsumerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteConsumer("dedupe")
+	defer func() { closeChan <- true }()
+	//other users can not suppress events by reusing a dedupe id
+	for _, username := range []string{"alice", "mallory"} {
+		event := NewEvent("consumer::dedupe", username)
+		event.Username = username
+		event.DedupeId = "order-1"
+		Publish(event)
+	}
+	for _, username := range []string{"alice", "mallory"} {
+		select {
+		case event := <-ch:
+			if event.Username != username || !Ack("dedupe", event.Id) {
+				t.Errorf("expected the event of %v, got %v", username, event)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("the event of %v was dropped", username)
+		}
+	}
+}
+
+/*
+restartConsumer forgets the consumer like a shutdown would, and restores it
+from its log.
+*/
+func restartConsumer(name string) {
+	cons := consumerByName(name)
+	consumers.Lock()
+	delete(consumers.byName, name)
+	consumers.Unlock()
+	cons.lock.Lock()
+	cons.log.close(false)
+	cons.log = nil
+	cons.lock.Unlock()
+	close(cons.done)
+	cons.closeChan <- true
+	restoreConsumers()
+}
+
+func TestConsumerPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consumers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*consumersDir = dir
+	defer func() { *consumersDir = "" }()
+
+	//declared consumers queue events before anybody consumes them
+	if err := DeclareConsumer("mailer", "consumer::mail", 0, ConsumerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteConsumer("mailer")
+	for _, payload := range []string{"acked", "unacked", "queued"} {
+		event := NewEvent("consumer::mail", payload)
+		event.DedupeId = payload
+		Publish(event)
+	}
+	time.Sleep(50 * time.Millisecond)
+	options := ConsumerOptions{MaxInflight: 2}
+	ch, closeChan, err := Consume("mailer", "consumer::mail", 0, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acked := <-ch; acked.Payload != "acked" || !Ack("mailer", acked.Id) {
+		t.Fatalf("expected to ack the first event, got %v", acked)
+	}
+	<-ch
+	closeChan <- true
+
+	restartConsumer("mailer")
+	//the dedupe keys survive the restart too
+	retry := NewEvent("consumer::mail", "acked")
+	retry.DedupeId = "acked"
+	Publish(retry)
+	ch, closeChan, err = Consume("mailer", "consumer::mail", 0, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { closeChan <- true }()
+	for _, expected := range []string{"unacked", "queued"} {
+		select {
+		case event := <-ch:
+			if event.Payload != expected {
+				t.Errorf("expected %v after the restart, got %v", expected, event.Payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v was lost by the restart", expected)
+		}
+	}
+	select {
+	case event := <-ch:
+		t.Errorf("unexpected delivery after the restart: %v", event.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
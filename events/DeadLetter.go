@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+If dead letters are enabled, events which could not be handled are reported
+with the reason to DEADLETTER_TOPIC, where they can be inspected or persisted
+by the journal. A dead letter names the topic, id and trace id of the event.
+Payloads can hold secrets like passwords, so the whole event is only
+included with events.deadletter.payload, and never for topics whose
+subscribers need a grant of the ACL or a permission required by
+RequirePermission. Dead letters are never dead lettered themselves.
+*/
+
+import (
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var deadLetters = flag.String("events.deadletter", "false", "whether to report unroutable and failed events to "+DEADLETTER_TOPIC)
+var deadLetterPayloads = flag.String("events.deadletter.payload", "false", "whether dead letters include the whole event with its payload")
+
+const DEADLETTER_TOPIC = "system::deadletter"
+
+const (
+	DEADLETTER_UNROUTABLE   = "unroutable"
+	DEADLETTER_UNAUTHORIZED = "unauthorized"
+	DEADLETTER_REJECTED     = "rejected"
+	DEADLETTER_PANIC        = "panic"
+)
+
+var deadLettersEnabled int32
+var deadLetterPayloadsEnabled int32
+
+func parseDeadLetters() bool {
+	enabled, err := strconv.ParseBool(*deadLetters)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	return enabled
+}
+
+func parseDeadLetterPayloads() bool {
+	enabled, err := strconv.ParseBool(*deadLetterPayloads)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	return enabled
+}
+
+func EnableDeadLetters(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&deadLettersEnabled, 1)
+	} else {
+		atomic.StoreInt32(&deadLettersEnabled, 0)
+	}
+}
+
+/*
+EnableDeadLetterPayloads makes dead letters include the whole event, except
+for restricted topics.
+*/
+func EnableDeadLetterPayloads(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&deadLetterPayloadsEnabled, 1)
+	} else {
+		atomic.StoreInt32(&deadLetterPayloadsEnabled, 0)
+	}
+}
+
+/*
+restrictedTopic tells whether the subscribers of topic need more than the
+permission to subscribe to events.
+*/
+func restrictedTopic(topic string) bool {
+	if subscribeGrant(topic) != nil {
+		return true
+	}
+	list, _ := topicPermissions.list.Load().([]*topicPermission)
+	for _, required := range list {
+		if strings.HasPrefix(topic, required.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+NewDeadLetter builds the event for DEADLETTER_TOPIC which reports event. It
+returns nil if dead letters are disabled or event is a dead letter itself.
+*/
+func NewDeadLetter(event *Event, reason, detail string) *Event {
+	if atomic.LoadInt32(&deadLettersEnabled) == 0 || event.Topic == DEADLETTER_TOPIC {
+		return nil
+	}
+	payload := map[string]interface{}{
+		"reason":  reason,
+		"detail":  detail,
+		"topic":   event.Topic,
+		"id":      event.Id,
+		"traceid": event.TraceId,
+	}
+	if atomic.LoadInt32(&deadLetterPayloadsEnabled) == 1 && !restrictedTopic(event.Topic) {
+		payload["event"] = event
+	}
+	letter := NewChildEvent(event, DEADLETTER_TOPIC, payload)
+	letter.AuthLevel = event.AuthLevel
+	return letter
+}
+
+/*
+DeadLetter publishes a dead letter for event. Callers which must not wait
+for the event system should publish NewDeadLetter on their own.
+*/
+func DeadLetter(event *Event, reason, detail string) {
+	if letter := NewDeadLetter(event, reason, detail); letter != nil {
+		Publish(letter)
+	}
+}
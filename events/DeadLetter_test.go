@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"github.com/trusch/susi/permissions"
+	"testing"
+)
+
+func TestDeadLetters(t *testing.T) {
+	EnableDeadLetters(true)
+	defer EnableDeadLetters(false)
+	letters, closeChan := Subscribe(DEADLETTER_TOPIC, 0)
+	defer func() { closeChan <- true }()
+
+	if err := TryPublish(NewEvent("deadletter::nobody", nil)); err == nil {
+		t.Fatal("expected an error for an unroutable event")
+	}
+	letter := (<-letters).Payload.(map[string]interface{})
+	if letter["reason"] != DEADLETTER_UNROUTABLE || letter["topic"] != "deadletter::nobody" {
+		t.Errorf("unexpected dead letter %v", letter)
+	}
+	if _, ok := letter["event"]; ok {
+		t.Error("payloads are only included if enabled")
+	}
+
+	_, closeSecured := Subscribe("deadletter::secured", 3)
+	defer func() { closeSecured <- true }()
+	secured := NewEvent("deadletter::secured", nil)
+	secured.AuthLevel = 0
+	TryPublish(secured)
+	if letter := (<-letters).Payload.(map[string]interface{}); letter["reason"] != DEADLETTER_UNAUTHORIZED {
+		t.Errorf("expected an unauthorized dead letter, got %v", letter)
+	}
+
+	EnableDeadLetterPayloads(true)
+	defer EnableDeadLetterPayloads(false)
+	failed := NewEvent("deadletter::failed", "payload")
+	if letter := NewDeadLetter(failed, DEADLETTER_PANIC, "").Payload.(map[string]interface{}); letter["event"] != failed {
+		t.Errorf("expected the whole event once payloads are enabled, got %v", letter)
+	}
+	RequirePermission("deadletter::secret::", permissions.STATE, permissions.READ)
+	if letter := NewDeadLetter(NewEvent("deadletter::secret::pin", 1234), DEADLETTER_PANIC, "").Payload.(map[string]interface{}); letter["event"] != nil {
+		t.Errorf("payloads of restricted topics must never be included, got %v", letter)
+	}
+
+	if NewDeadLetter(NewEvent(DEADLETTER_TOPIC, nil), DEADLETTER_UNROUTABLE, "") != nil {
+		t.Error("dead letters must not be dead lettered again")
+	}
+}
@@ -13,7 +13,6 @@ package events
 
 import (
 	"fmt"
-	"time"
 )
 
 type Event struct {
@@ -24,11 +23,21 @@ type Event struct {
 	ReturnAddr string      `json:"returnaddr"`
 	Payload    interface{} `json:"payload,omitempty"`
 	Username   string      `json:"username,omitempty"`
+	Offset     uint64      `json:"offset,omitempty"`
+	Retain     bool        `json:"retain,omitempty"`
+	TraceId    uint64      `json:"traceid,string,omitempty"`
+	ParentId   uint64      `json:"parentid,string,omitempty"`
+	//only Go code may choose the lane, clients get the priority of the topic
+	Priority Priority `json:"-"`
+	//chosen by publishers which retry, durable consumers drop events whose user already sent the same DedupeId
+	DedupeId string `json:"dedupeid,omitempty"`
+	//Roles of the publisher, empty means the roles its authlevel maps to
+	Roles []string `json:"-"`
 }
 
 func NewEvent(topic string, payload interface{}) *Event {
 	return &Event{
-		Id:        uint64(time.Now().UnixNano()),
+		Id:        NextId(),
 		Topic:     topic,
 		AuthLevel: 255,
 		Payload:   payload,
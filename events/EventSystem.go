@@ -17,21 +17,39 @@ This provides a Publish-Subscribe server for the system
 
 import (
 	"log"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type CommandType uint8
-
-const (
-	SUBSCRIBE CommandType = iota
-	UNSUBSCRIBE
-	PUBLISH
-)
-
+/*
+Subscriptions to plain topics live in the shard their topic hashes to, and every
+shard has its own dispatcher goroutine, so publishes to different topics are
+fanned out in parallel. Glob and wildcard subscriptions are kept in one snapshot
+which all shards share.
+Readers never lock: subscribe and unsubscribe build a new snapshot and swap it in.
+*/
 type EventSystem struct {
-	cmdChan chan *command
-	topics  map[string]map[uint64]*subscription
-	globs   map[uint64]*subscription
+	shards       []*shard
+	patternLock  sync.Mutex
+	patterns     atomic.Value //*patternSnapshot
+	droppedLock  sync.Mutex
+	dropped      map[string]uint64
+	journalLock  sync.RWMutex
+	journal      *Journal
+	retainedLock sync.RWMutex
+	retained     map[string]*Event
+	statsLock    sync.Mutex
+	queueStats   map[Priority]*QueueStat
+	rates        map[string]float64
+	lastCounts   map[string]uint64
+}
+
+type patternSnapshot struct {
+	globs     map[uint64]*subscription
+	wildcards *topicTrie
 }
 
 type globChan struct {
@@ -44,50 +62,85 @@ func isGlob(pattern string) bool {
 }
 
 type command struct {
-	Type   CommandType
-	Event  *Event
-	Result chan interface{}
+	Event    *Event
+	Enqueued time.Time
+	Result   chan publishResult
 }
 
 var eventSystem *EventSystem
 
 func Go() {
+	DefaultRequestTimeout = parseRequestTimeout()
+	EnableDeadLetters(parseDeadLetters())
+	EnableDeadLetterPayloads(parseDeadLetterPayloads())
+	maxStatsTopics = parseStatsMaxTopics()
+	if hostname, err := os.Hostname(); err == nil {
+		Identity = hostname
+	}
 	eventSystem = new(EventSystem)
-	eventSystem.cmdChan = make(chan *command, 10)
-	eventSystem.topics = make(map[string]map[uint64]*subscription)
-	eventSystem.globs = make(map[uint64]*subscription)
-	go func() {
-		for cmd := range eventSystem.cmdChan {
-			switch cmd.Type {
-			case SUBSCRIBE:
-				{
-					ec, cc := eventSystem.subscribe(cmd.Event.Topic, cmd.Event.AuthLevel)
-					cmd.Result <- subscribeResult{
-						EventChan: ec,
-						CloseChan: cc,
-					}
-				}
-			case PUBLISH:
-				{
-					cmd.Result <- eventSystem.publish(cmd.Event)
-				}
-			case UNSUBSCRIBE:
-				{
-					eventSystem.unsubscribe(cmd.Event.Topic, cmd.Event.Payload.(uint64))
-				}
-			}
+	eventSystem.patterns.Store(&patternSnapshot{
+		globs:     make(map[uint64]*subscription),
+		wildcards: newTopicTrie(),
+	})
+	eventSystem.dropped = make(map[string]uint64)
+	eventSystem.retained = make(map[string]*Event)
+	eventSystem.queueStats = make(map[Priority]*QueueStat)
+	eventSystem.rates = make(map[string]float64)
+	eventSystem.lastCounts = make(map[string]uint64)
+	count := parseShardCount()
+	eventSystem.shards = make([]*shard, count)
+	for i := range eventSystem.shards {
+		eventSystem.shards[i] = newShard()
+		go eventSystem.shards[i].backend()
+	}
+	droppedChan, _ := Subscribe(DROPPED_TOPIC, 0)
+	go serveDroppedCounters(droppedChan)
+	queuesChan, _ := Subscribe(QUEUES_TOPIC, 0)
+	go serveQueueStats(queuesChan)
+	rateLimitedChan, _ := Subscribe(RATELIMITED_TOPIC, 0)
+	go serveRateLimitedCounters(rateLimitedChan)
+	statsChan, _ := Subscribe(STATS_TOPIC, 0)
+	go serveStats(statsChan)
+	go eventSystem.sampleRates(STATS_SAMPLE_INTERVAL)
+	if *journalFile != "" {
+		if err := EnableJournal(*journalFile, parseJournalTopics(*journalTopics)); err != nil {
+			log.Print(err)
 		}
-	}()
-	log.Print("successfully started EventSystem")
+	}
+	restoreConsumers()
+	log.Printf("successfully started EventSystem with %v shards", count)
+}
+
+func (eventSystem *EventSystem) currentPatterns() *patternSnapshot {
+	return eventSystem.patterns.Load().(*patternSnapshot)
+}
+
+func (eventSystem *EventSystem) currentJournal() *Journal {
+	eventSystem.journalLock.RLock()
+	defer eventSystem.journalLock.RUnlock()
+	return eventSystem.journal
+}
+
+func (eventSystem *EventSystem) drop(topic string) {
+	eventSystem.droppedLock.Lock()
+	defer eventSystem.droppedLock.Unlock()
+	eventSystem.dropped[trackedTopic(eventSystem.dropped, topic)]++
 }
 
 func Reset() {
-	for topic, subs := range eventSystem.topics {
-		for id, _ := range subs {
-			eventSystem.unsubscribe(topic, id)
+	for _, shard := range eventSystem.shards {
+		for topic, subs := range shard.current() {
+			for _, sub := range subs {
+				eventSystem.unsubscribe(topic, sub.Id)
+			}
 		}
 	}
-	for id, _ := range eventSystem.globs {
+	patterns := eventSystem.currentPatterns()
+	for id, _ := range patterns.globs {
 		eventSystem.unsubscribe("", id)
 	}
+	for _, subscription := range patterns.wildcards.all() {
+		eventSystem.unsubscribe(subscription.Topic, subscription.Id)
+	}
+	eventSystem.resetStats()
 }
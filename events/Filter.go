@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+A Filter lets a subscription receive only events whose payload matches.
+Filters are written as objects mapping payload fields to conditions:
+	{"device.type": "sensor", "temp": {"$gt": 20, "$lte": 30}, "state": {"$in": ["on", "off"]}, "error": {"$exists": false}}
+Nested fields are addressed with dots, the empty field name addresses the
+payload itself. A plain value tests for equality, an object combines the
+operators $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin and $exists.
+All conditions must hold.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+type Filter struct {
+	conditions []*filterCondition
+}
+
+type filterCondition struct {
+	Path     []string
+	Operator string
+	Value    interface{}
+}
+
+var filterOperators = map[string]bool{
+	"$eq":     true,
+	"$ne":     true,
+	"$gt":     true,
+	"$gte":    true,
+	"$lt":     true,
+	"$lte":    true,
+	"$in":     true,
+	"$nin":    true,
+	"$exists": true,
+}
+
+func ParseFilter(spec map[string]interface{}) (*Filter, error) {
+	filter := new(Filter)
+	for field, condition := range spec {
+		var path []string
+		if field != "" {
+			path = strings.Split(field, ".")
+		}
+		operators, ok := condition.(map[string]interface{})
+		if !ok || !isOperatorMap(operators) {
+			filter.conditions = append(filter.conditions, &filterCondition{path, "$eq", condition})
+			continue
+		}
+		for operator, value := range operators {
+			if !filterOperators[operator] {
+				return nil, errors.New("no such filter operator: " + operator)
+			}
+			switch operator {
+			case "$in", "$nin":
+				{
+					if _, ok := value.([]interface{}); !ok {
+						return nil, errors.New(operator + " needs a list")
+					}
+				}
+			case "$exists":
+				{
+					if _, ok := value.(bool); !ok {
+						return nil, errors.New("$exists needs a boolean")
+					}
+				}
+			}
+			filter.conditions = append(filter.conditions, &filterCondition{path, operator, value})
+		}
+	}
+	return filter, nil
+}
+
+func isOperatorMap(operators map[string]interface{}) bool {
+	for key := range operators {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return len(operators) > 0
+}
+
+/*
+Match tests the payload against all conditions. Payloads which are not
+generic json values (e.g. decoded by a TypeCodec) are looked at in their
+json form.
+*/
+func (filter *Filter) Match(payload interface{}) bool {
+	return filter.matchView(filterView(payload))
+}
+
+func (filter *Filter) matchView(payload interface{}) bool {
+	for _, condition := range filter.conditions {
+		if !condition.match(payload) {
+			return false
+		}
+	}
+	return true
+}
+
+func filterView(payload interface{}) interface{} {
+	switch payload.(type) {
+	case nil, map[string]interface{}, []interface{}, string, bool, float64:
+		return payload
+	}
+	marshaled, err := json.Marshal(payload)
+	if err != nil {
+		return payload
+	}
+	var view interface{}
+	if err := json.Unmarshal(marshaled, &view); err != nil {
+		return payload
+	}
+	return view
+}
+
+func (condition *filterCondition) match(payload interface{}) bool {
+	value, exists := lookupPath(payload, condition.Path)
+	switch condition.Operator {
+	case "$exists":
+		return exists == condition.Value.(bool)
+	case "$eq":
+		return exists && filterEqual(value, condition.Value)
+	case "$ne":
+		return !exists || !filterEqual(value, condition.Value)
+	case "$in", "$nin":
+		{
+			found := false
+			if exists {
+				for _, candidate := range condition.Value.([]interface{}) {
+					if filterEqual(value, candidate) {
+						found = true
+						break
+					}
+				}
+			}
+			return found == (condition.Operator == "$in")
+		}
+	}
+	if !exists {
+		return false
+	}
+	cmp, ok := filterCompare(value, condition.Value)
+	if !ok {
+		return false
+	}
+	switch condition.Operator {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+func lookupPath(payload interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		obj, ok := payload.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if payload, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return payload, true
+}
+
+/*
+filterNumber accepts all numeric kinds, because payloads published from go
+carry whatever type the publisher used.
+*/
+func filterNumber(value interface{}) (float64, bool) {
+	if number, ok := value.(float64); ok {
+		return number, true
+	}
+	if value == nil {
+		return 0, false
+	}
+	number := reflect.ValueOf(value)
+	switch number.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return number.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(number.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(number.Uint()), true
+	}
+	return 0, false
+}
+
+/*
+filterEqual compares like json does, so 2 equals 2.0 also inside objects
+and lists.
+*/
+func filterEqual(a, b interface{}) bool {
+	if x, ok := filterNumber(a); ok {
+		if y, ok := filterNumber(b); ok {
+			return x == y
+		}
+	}
+	switch x := a.(type) {
+	case map[string]interface{}:
+		{
+			y, ok := b.(map[string]interface{})
+			if !ok || len(x) != len(y) {
+				return false
+			}
+			for key, value := range x {
+				if other, ok := y[key]; !ok || !filterEqual(value, other) {
+					return false
+				}
+			}
+			return true
+		}
+	case []interface{}:
+		{
+			y, ok := b.([]interface{})
+			if !ok || len(x) != len(y) {
+				return false
+			}
+			for i := range x {
+				if !filterEqual(x[i], y[i]) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+/*
+filterCompare orders two numbers or two strings.
+*/
+func filterCompare(a, b interface{}) (int, bool) {
+	if x, ok := filterNumber(a); ok {
+		if y, ok := filterNumber(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	x, ok1 := a.(string)
+	y, ok2 := b.(string)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return strings.Compare(x, y), true
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func parseTestFilter(t *testing.T, spec string) *Filter {
+	data := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(spec), &data); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := ParseFilter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func TestFilterMatch(t *testing.T) {
+	payload := map[string]interface{}{
+		"temp":   22.5,
+		"state":  "on",
+		"device": map[string]interface{}{"type": "sensor", "floor": 2},
+	}
+	samples := []struct {
+		spec     string
+		expected bool
+	}{
+		{`{"state": "on"}`, true},
+		{`{"state": "off"}`, false},
+		{`{"device.type": "sensor", "device.floor": 2}`, true},
+		{`{"temp": {"$gt": 20, "$lte": 22.5}}`, true},
+		{`{"temp": {"$lt": 20}}`, false},
+		{`{"state": {"$in": ["on", "standby"]}}`, true},
+		{`{"state": {"$nin": ["on", "standby"]}}`, false},
+		{`{"error": {"$exists": false}, "temp": {"$exists": true}}`, true},
+		{`{"device.room": {"$ne": "kitchen"}}`, true},
+		{`{"state": {"$gt": "off"}}`, true},
+		{`{"temp": {"$gt": "20"}}`, false},
+		{`{"device": {"type": "sensor", "floor": 2}}`, true},
+	}
+	for _, sample := range samples {
+		if result := parseTestFilter(t, sample.spec).Match(payload); result != sample.expected {
+			t.Errorf("%v: expected %v, got %v", sample.spec, sample.expected, result)
+		}
+	}
+	if _, err := ParseFilter(map[string]interface{}{"temp": map[string]interface{}{"$near": 1}}); err == nil {
+		t.Error("expected unknown operators to be rejected")
+	}
+}
+
+func TestFilterNumberKinds(t *testing.T) {
+	for _, value := range []interface{}{int8(3), int16(3), int32(3), int64(3), 3, uint(3), uint8(3), uint16(3), uint32(3), uint64(3), uintptr(3), float32(3), 3.0, Priority(3)} {
+		if number, ok := filterNumber(value); !ok || number != 3 {
+			t.Errorf("expected %T to be the number 3, got %v", value, number)
+		}
+		filter := parseTestFilter(t, `{"level": {"$gte": 3, "$lt": 4}}`)
+		if !filter.Match(map[string]interface{}{"level": value}) {
+			t.Errorf("expected a %T payload to match", value)
+		}
+	}
+	if _, ok := filterNumber("3"); ok {
+		t.Error("strings are no numbers")
+	}
+}
+
+func TestFilteredSubscription(t *testing.T) {
+	filter := parseTestFilter(t, `{"level": {"$gte": 3}}`)
+	ch, closeChan := SubscribeWithOptions("filter::alarms", 0, SubscribeOptions{Filter: filter})
+	defer func() { closeChan <- true }()
+	for level := 0; level < 5; level++ {
+		if !Publish(NewEvent("filter::alarms", map[string]interface{}{"level": level})) {
+			t.Error("filtered events still count as routed")
+		}
+	}
+	if len(ch) != 2 {
+		t.Errorf("expected 2 alarms to pass the filter, got %v", len(ch))
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+Subscriptions with the same topic and SubscribeOptions.Group form a queue
+group: each event is delivered to only one member of the group, chosen by
+the BalancePolicy of the group's oldest member.
+*/
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type BalancePolicy uint8
+
+const (
+	ROUND_ROBIN BalancePolicy = iota
+	LEAST_LOADED
+)
+
+var balanceNames = map[BalancePolicy]string{
+	ROUND_ROBIN:  "round-robin",
+	LEAST_LOADED: "least-loaded",
+}
+
+func (policy BalancePolicy) String() string {
+	return balanceNames[policy]
+}
+
+func ParseBalancePolicy(name string) (BalancePolicy, error) {
+	for policy, policyName := range balanceNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return ROUND_ROBIN, errors.New("no such balance policy: " + name)
+}
+
+/*
+A group counter rotates the members of a round robin group. It is deleted
+once the last member left, so groups of short-lived subscribers do not pile up.
+*/
+type groupCounter struct {
+	next    uint64
+	members int
+}
+
+var groupCounters = struct {
+	sync.Mutex
+	counters map[string]*groupCounter
+}{counters: make(map[string]*groupCounter)}
+
+func groupKey(sub *subscription) string {
+	return sub.Topic + "\x00" + sub.Group
+}
+
+func joinGroup(sub *subscription) {
+	groupCounters.Lock()
+	defer groupCounters.Unlock()
+	key := groupKey(sub)
+	counter, ok := groupCounters.counters[key]
+	if !ok {
+		counter = new(groupCounter)
+		groupCounters.counters[key] = counter
+	}
+	counter.members++
+}
+
+func leaveGroup(sub *subscription) {
+	groupCounters.Lock()
+	defer groupCounters.Unlock()
+	key := groupKey(sub)
+	if counter, ok := groupCounters.counters[key]; ok {
+		if counter.members--; counter.members <= 0 {
+			delete(groupCounters.counters, key)
+		}
+	}
+}
+
+/*
+nextMember returns the rotation counter of the group after adding one. A
+dispatcher can still deliver to a group whose last member just left, so a
+missing counter is not created again.
+*/
+func nextMember(key string) uint64 {
+	groupCounters.Lock()
+	counter, ok := groupCounters.counters[key]
+	groupCounters.Unlock()
+	if !ok {
+		return 0
+	}
+	return atomic.AddUint64(&counter.next, 1)
+}
+
+/*
+deliverTargets delivers event to all targets which are not in a group and to
+one member of each group. It returns the number of deliveries.
+*/
+func (eventSystem *EventSystem) deliverTargets(targets []*subscription, event *Event) (deliveries int) {
+	var groups map[string][]*subscription
+	for _, sub := range targets {
+		if sub.Group == "" {
+			eventSystem.deliver(sub, event)
+			deliveries++
+			continue
+		}
+		if groups == nil {
+			groups = make(map[string][]*subscription)
+		}
+		key := groupKey(sub)
+		groups[key] = append(groups[key], sub)
+	}
+	for key, members := range groups {
+		eventSystem.deliver(pickMember(key, members), event)
+	}
+	return deliveries + len(groups)
+}
+
+func pickMember(key string, members []*subscription) *subscription {
+	if len(members) == 1 {
+		return members[0]
+	}
+	//wildcard matches come from a map, so sort them for a stable rotation
+	sort.Sort(byId(members))
+	switch members[0].Balance {
+	case LEAST_LOADED:
+		{
+			best := members[0]
+			for _, member := range members[1:] {
+				if len(member.EventChan) < len(best.EventChan) {
+					best = member
+				}
+			}
+			return best
+		}
+	}
+	return members[nextMember(key)%uint64(len(members))]
+}
+
+type byId []*subscription
+
+func (subs byId) Len() int           { return len(subs) }
+func (subs byId) Less(i, j int) bool { return subs[i].Id < subs[j].Id }
+func (subs byId) Swap(i, j int)      { subs[i], subs[j] = subs[j], subs[i] }
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueueGroups(t *testing.T) {
+	options := SubscribeOptions{Group: "workers"}
+	first, closeFirst := SubscribeWithOptions("group::jobs", 0, options)
+	second, closeSecond := SubscribeWithOptions("group::jobs", 0, options)
+	all, closeAll := Subscribe("group::jobs", 0)
+	defer func() {
+		closeFirst <- true
+		closeSecond <- true
+		closeAll <- true
+	}()
+
+	for i := 0; i < 10; i++ {
+		Publish(NewEvent("group::jobs", i))
+	}
+	if len(first) != 5 || len(second) != 5 {
+		t.Errorf("expected round robin to split 5/5, got %v/%v", len(first), len(second))
+	}
+	if len(all) != 10 {
+		t.Errorf("expected the plain subscription to get all 10 events, got %v", len(all))
+	}
+
+	options.Group = "lazy"
+	options.Balance = LEAST_LOADED
+	busy, closeBusy := SubscribeWithOptions("group::jobs", 0, options)
+	idle, closeIdle := SubscribeWithOptions("group::jobs", 0, options)
+	defer func() {
+		closeBusy <- true
+		closeIdle <- true
+	}()
+	//on a tie the oldest member wins, afterwards the idle member gets everything
+	Publish(NewEvent("group::jobs", 0))
+	for i := 1; i < 4; i++ {
+		Publish(NewEvent("group::jobs", i))
+		<-idle
+	}
+	if len(busy) != 1 {
+		t.Errorf("expected the busy member to get only the first event, got %v", len(busy))
+	}
+}
+
+func TestQueueGroupCountersArePruned(t *testing.T) {
+	topic := "group::pruned::" + strconv.FormatUint(NextId(), 10)
+	options := SubscribeOptions{Group: "workers"}
+	_, closeFirst := SubscribeWithOptions(topic, 0, options)
+	second, closeSecond := SubscribeWithOptions(topic, 0, options)
+	key := topic + "\x00workers"
+	counted := func() bool {
+		groupCounters.Lock()
+		defer groupCounters.Unlock()
+		_, ok := groupCounters.counters[key]
+		return ok
+	}
+	Publish(NewEvent(topic, nil))
+	if !counted() {
+		t.Fatal("expected a counter while the group has members")
+	}
+	closeFirst <- true
+	closeSecond <- true
+	for _ = range second {
+	}
+	time.Sleep(10 * time.Millisecond)
+	if counted() {
+		t.Error("expected the counter to be deleted with the last member")
+	}
+}
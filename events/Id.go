@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+IdGenerator hands out monotonic ids which are unique within the process.
+*/
+type IdGenerator struct {
+	last uint64
+}
+
+func NewIdGenerator(start uint64) *IdGenerator {
+	return &IdGenerator{last: start}
+}
+
+func (gen *IdGenerator) Next() uint64 {
+	return atomic.AddUint64(&gen.last, 1)
+}
+
+/*
+The global generator is seeded with the startup time, so ids keep the
+magnitude of the former UnixNano ids (session cookies rely on that).
+*/
+var ids = NewIdGenerator(uint64(time.Now().UnixNano()))
+
+func NextId() uint64 {
+	return ids.Next()
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNextIdIsUnique(t *testing.T) {
+	results := make(chan uint64, 10000)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				results <- NextId()
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	seen := make(map[uint64]bool)
+	for id := range results {
+		if seen[id] {
+			t.Fatalf("id %v was generated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestConcurrentSubscribes(t *testing.T) {
+	const subscribers = 1000
+	chans := make(chan chan *Event, subscribers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < subscribers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch, _ := Subscribe("hammer", 0)
+			chans <- ch
+		}()
+	}
+	wg.Wait()
+	close(chans)
+
+	go Publish(NewEvent("hammer", nil))
+
+	received := 0
+	for ch := range chans {
+		if event := <-ch; event.Topic == "hammer" {
+			received++
+		}
+	}
+	if received != subscribers {
+		t.Errorf("expected %v subscribers to receive the event, got %v", subscribers, received)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"sync"
+)
+
+/*
+An Interceptor runs on every published event before it is handed to the
+subscribers. It can inspect and modify the event (payload validation, topic
+rewriting, auditing...) or reject it by returning an error.
+Interceptors run in the goroutine of the publisher, in registration order.
+An interceptor registered for a topic pattern only sees the events matching it.
+*/
+type Interceptor func(event *Event) error
+
+type interceptorEntry struct {
+	Name string
+	//empty means all topics
+	Pattern     string
+	Interceptor Interceptor
+}
+
+var interceptors struct {
+	sync.RWMutex
+	chain []*interceptorEntry
+}
+
+/*
+Returned by TryPublish if an interceptor rejected the event.
+*/
+type RejectedError struct {
+	Interceptor string
+	Reason      string
+}
+
+func (err *RejectedError) Error() string {
+	return "event rejected by " + err.Interceptor + ": " + err.Reason
+}
+
+/*
+RegisterInterceptor appends an interceptor for all topics to the chain. An
+interceptor which is already registered under the same name is replaced in place.
+*/
+func RegisterInterceptor(name string, interceptor Interceptor) {
+	RegisterTopicInterceptor(name, "", interceptor)
+}
+
+/*
+RegisterTopicInterceptor is like RegisterInterceptor, but the interceptor only
+runs on events whose topic matches pattern.
+*/
+func RegisterTopicInterceptor(name, pattern string, interceptor Interceptor) {
+	interceptors.Lock()
+	defer interceptors.Unlock()
+	//the chain is copied on write, so intercept can run it without holding the lock
+	chain := make([]*interceptorEntry, 0, len(interceptors.chain)+1)
+	replaced := false
+	for _, entry := range interceptors.chain {
+		if entry.Name == name {
+			entry = &interceptorEntry{name, pattern, interceptor}
+			replaced = true
+		}
+		chain = append(chain, entry)
+	}
+	if !replaced {
+		chain = append(chain, &interceptorEntry{name, pattern, interceptor})
+	}
+	interceptors.chain = chain
+}
+
+func UnregisterInterceptor(name string) {
+	interceptors.Lock()
+	defer interceptors.Unlock()
+	chain := make([]*interceptorEntry, 0, len(interceptors.chain))
+	for _, entry := range interceptors.chain {
+		if entry.Name != name {
+			chain = append(chain, entry)
+		}
+	}
+	interceptors.chain = chain
+}
+
+func intercept(event *Event) error {
+	interceptors.RLock()
+	chain := interceptors.chain
+	interceptors.RUnlock()
+	for _, entry := range chain {
+		if entry.Pattern != "" && !Match(entry.Pattern, event.Topic) {
+			continue
+		}
+		if err := entry.Interceptor(event); err != nil {
+			return &RejectedError{entry.Name, err.Error()}
+		}
+	}
+	return nil
+}
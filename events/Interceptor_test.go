@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInterceptorChain(t *testing.T) {
+	order := make([]string, 0)
+	RegisterTopicInterceptor("first", "intercept::#", func(event *Event) error {
+		order = append(order, "first")
+		event.Topic = "intercept::rewritten"
+		return nil
+	})
+	defer UnregisterInterceptor("first")
+	RegisterTopicInterceptor("second", "intercept::rewritten", func(event *Event) error {
+		order = append(order, "second")
+		event.Payload = "modified"
+		return nil
+	})
+	defer UnregisterInterceptor("second")
+	RegisterTopicInterceptor("elsewhere", "other::#", func(event *Event) error {
+		order = append(order, "elsewhere")
+		return nil
+	})
+	defer UnregisterInterceptor("elsewhere")
+
+	original, closeOriginal := Subscribe("intercept::original", 0)
+	defer func() { closeOriginal <- true }()
+	rewritten, closeRewritten := Subscribe("intercept::rewritten", 0)
+	defer func() { closeRewritten <- true }()
+	if err := TryPublish(NewEvent("intercept::original", "payload")); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("expected the matching interceptors in registration order, got %v", order)
+	}
+	if len(original) != 0 {
+		t.Error("the event must only reach its new topic")
+	}
+	if event := <-rewritten; event.Payload != "modified" {
+		t.Errorf("expected the modified payload, got %v", event.Payload)
+	}
+}
+
+func TestInterceptorRejection(t *testing.T) {
+	RegisterTopicInterceptor("guard", "intercept::guarded", func(event *Event) error {
+		return errors.New("not today")
+	})
+	defer UnregisterInterceptor("guard")
+	ch, closeChan := Subscribe("intercept::guarded", 0)
+	defer func() { closeChan <- true }()
+	awnsers, closeAwnsers := Subscribe("intercept::awnser", 0)
+	defer func() { closeAwnsers <- true }()
+
+	event := NewEvent("intercept::guarded", nil)
+	event.ReturnAddr = "intercept::awnser"
+	err := TryPublish(event)
+	if rejected, ok := err.(*RejectedError); !ok || rejected.Interceptor != "guard" || rejected.Reason != "not today" {
+		t.Errorf("expected a RejectedError of guard, got %v", err)
+	}
+	if len(ch) != 0 {
+		t.Error("a rejected event must not be delivered")
+	}
+	if _, err := parseAwnser(<-awnsers); err == nil || err.Error() != (&RejectedError{"guard", "not today"}).Error() {
+		t.Errorf("expected the rejection as awnser, got %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+The journal is an optional append-only file of published events. Every
+journaled event gets a monotonic offset, so subscribers can catch up on
+everything they missed by subscribing "from offset N" or "from time T".
+Only the topics listed in events.journal.topics are journaled, never the
+excluded ones (credentials pass the authentification topics) nor the awnser
+topics of requests. Once the file grows beyond events.journal.maxsize it is
+rotated to file.1, file.2 and so on, keeping events.journal.segments old files.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var journalFile = flag.String("events.journal.file", "", "where to journal events (empty disables the journal)")
+var journalTopics = flag.String("events.journal.topics", "", "comma separated list of topic patterns to journal")
+var journalExclude = flag.String("events.journal.exclude", "authentification::#,controller::auth::#,session::#", "comma separated list of topic patterns never to journal")
+var journalMaxSize = flag.String("events.journal.maxsize", "104857600", "size in bytes after which the journal is rotated (0 disables the rotation)")
+var journalSegments = flag.String("events.journal.segments", "3", "how many rotated journal files are kept")
+
+type journalEntry struct {
+	Offset uint64 `json:"offset"`
+	Time   int64  `json:"time"`
+	Event  *Event `json:"event"`
+}
+
+type Journal struct {
+	lock     sync.Mutex
+	filename string
+	file     *os.File
+	patterns []string
+	excludes []string
+	offset   uint64
+	size     int64
+	maxSize  int64
+	segments int
+}
+
+/*
+EnableJournal opens (or creates) the journal file and starts journaling all
+events whose topic matches one of the patterns.
+*/
+func EnableJournal(filename string, patterns []string) error {
+	journal, err := openJournal(filename, patterns)
+	if err != nil {
+		return err
+	}
+	eventSystem.journalLock.Lock()
+	defer eventSystem.journalLock.Unlock()
+	eventSystem.journal = journal
+	return nil
+}
+
+func openJournal(filename string, patterns []string) (*Journal, error) {
+	journal := &Journal{
+		filename: filename,
+		patterns: patterns,
+		excludes: parseJournalTopics(*journalExclude),
+		offset:   1,
+		maxSize:  parseJournalNumber(*journalMaxSize),
+		segments: int(parseJournalNumber(*journalSegments)),
+	}
+	if err := journal.open(); err != nil {
+		return nil, err
+	}
+	err := journal.scan(func(entry *journalEntry) {
+		journal.offset = entry.Offset + 1
+	})
+	if err != nil {
+		journal.file.Close()
+		return nil, err
+	}
+	log.Printf("opened event journal %v at offset %v", filename, journal.offset)
+	return journal, nil
+}
+
+func (journal *Journal) open() error {
+	file, err := os.OpenFile(journal.filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	journal.file = file
+	journal.size = info.Size()
+	return nil
+}
+
+func parseJournalNumber(value string) int64 {
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Print(err)
+		return 0
+	}
+	return number
+}
+
+func parseJournalTopics(topics string) []string {
+	patterns := make([]string, 0)
+	for _, pattern := range strings.Split(topics, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func (journal *Journal) matches(topic string) bool {
+	if statsTopic(topic) != topic {
+		return false
+	}
+	for _, pattern := range journal.excludes {
+		if Match(pattern, topic) {
+			return false
+		}
+	}
+	for _, pattern := range journal.patterns {
+		if Match(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+append is called by the dispatchers of all shards, so the journal
+serializes them to keep the offsets monotonic within the file. The event may
+be shared with its publisher, so append returns a copy carrying the offset.
+*/
+func (journal *Journal) append(event *Event) *Event {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	journaled := *event
+	journaled.Offset = journal.offset
+	data, err := json.Marshal(&journalEntry{
+		Offset: journaled.Offset,
+		Time:   time.Now().UnixNano(),
+		Event:  &journaled,
+	})
+	if err == nil {
+		_, err = journal.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		log.Print("failed journaling event: ", err)
+		return event
+	}
+	journal.offset++
+	journal.size += int64(len(data) + 1)
+	if journal.maxSize > 0 && journal.size >= journal.maxSize {
+		if err := journal.rotate(); err != nil {
+			log.Print("failed rotating event journal: ", err)
+		}
+	}
+	return &journaled
+}
+
+func (journal *Journal) segment(i int) string {
+	if i == 0 {
+		return journal.filename
+	}
+	return journal.filename + "." + strconv.Itoa(i)
+}
+
+/*
+rotate moves the journal file to file.1 (and file.1 to file.2 and so on),
+dropping the oldest segment, and starts a new file. It is called with the
+lock held.
+*/
+func (journal *Journal) rotate() error {
+	journal.file.Close()
+	if journal.segments <= 0 {
+		os.Remove(journal.filename)
+	} else {
+		os.Remove(journal.segment(journal.segments))
+		for i := journal.segments - 1; i >= 0; i-- {
+			if err := os.Rename(journal.segment(i), journal.segment(i+1)); err != nil && !os.IsNotExist(err) {
+				log.Print(err)
+			}
+		}
+	}
+	return journal.open()
+}
+
+func (journal *Journal) currentOffset() uint64 {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	return journal.offset
+}
+
+/*
+scan reads all segments of the journal, oldest first, from separate file
+handles, so it can run concurrently with appends of the dispatchers. The
+segments are opened at once, so a rotation can not shift them while reading.
+*/
+func (journal *Journal) scan(callback func(entry *journalEntry)) error {
+	files := make([]*os.File, 0, journal.segments+1)
+	journal.lock.Lock()
+	for i := journal.segments; i >= 0; i-- {
+		file, err := os.Open(journal.segment(i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			journal.lock.Unlock()
+			for _, file := range files {
+				file.Close()
+			}
+			return err
+		}
+		files = append(files, file)
+	}
+	journal.lock.Unlock()
+	for _, file := range files {
+		journal.scanFile(file, callback)
+		file.Close()
+	}
+	return nil
+}
+
+func (journal *Journal) scanFile(file *os.File, callback func(entry *journalEntry)) {
+	decoder := json.NewDecoder(file)
+	for {
+		entry := new(journalEntry)
+		if err := decoder.Decode(entry); err != nil {
+			if err != io.EOF {
+				log.Print("stopped reading event journal: ", err)
+			}
+			return
+		}
+		callback(entry)
+	}
+}
+
+/*
+replay feeds all journaled events between the requested start and upTo
+(exclusive) into the subscription, then flushes the events which were
+published in the meantime. upTo is read after the subscription was added, so
+events which made it into both the journal window and the backlog are skipped.
+*/
+func (journal *Journal) replay(sub *subscription, options *SubscribeOptions, upTo uint64) {
+	journal.scan(func(entry *journalEntry) {
+		if entry.Offset < options.FromOffset || entry.Offset >= upTo {
+			return
+		}
+		if !options.FromTime.IsZero() && entry.Time < options.FromTime.UnixNano() {
+			return
+		}
+		if !Match(sub.Topic, entry.Event.Topic) || !sub.permits(entry.Event, subscribeGrant(entry.Event.Topic)) {
+			return
+		}
+		entry.Event.Offset = entry.Offset
+		if payload, err := DecodePayload(entry.Event.Topic, entry.Event.Payload); err == nil {
+			entry.Event.Payload = payload
+		}
+		if !sub.accepts(entry.Event) {
+			return
+		}
+		sub.lock.Lock()
+		defer sub.lock.Unlock()
+		if !sub.closed {
+			eventSystem.deliverNow(sub, entry.Event)
+		}
+	})
+	//the backlog stays in place until it is empty, so events delivered while
+	//a blocking delivery waits are queued behind the rest of it
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	for len(sub.backlog) > 0 && !sub.closed {
+		event := sub.backlog[0]
+		sub.backlog = sub.backlog[1:]
+		if event.Offset > 0 && event.Offset < upTo {
+			continue
+		}
+		eventSystem.deliverNow(sub, event)
+	}
+	sub.backlog = nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func disableJournal() {
+	eventSystem.journalLock.Lock()
+	defer eventSystem.journalLock.Unlock()
+	eventSystem.journal = nil
+}
+
+func TestJournalReplay(t *testing.T) {
+	filename := os.TempDir() + "/susi-journal-test.json"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	if err := EnableJournal(filename, []string{"journal::#"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		Publish(NewEvent("journal::test", i))
+	}
+	Publish(NewEvent("not::journaled", nil))
+
+	ch, closeChan := SubscribeWithOptions("journal::#", 0, SubscribeOptions{FromOffset: 2})
+	defer func() { closeChan <- true }()
+	Publish(NewEvent("journal::live", 3))
+
+	for _, expected := range []uint64{2, 3, 4} {
+		event := <-ch
+		if event.Offset != expected {
+			t.Errorf("expected event with offset %v, got %v", expected, event)
+		}
+	}
+}
+
+func TestJournalExclusion(t *testing.T) {
+	filename := os.TempDir() + "/susi-journal-exclusion-test.json"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	if err := EnableJournal(filename, []string{"#"}); err != nil {
+		t.Fatal(err)
+	}
+	defer disableJournal()
+	published := NewEvent("journal::copied", nil)
+	Publish(published)
+	Publish(NewEvent("authentification::checkuser", map[string]interface{}{"password": "secret"}))
+	Publish(NewEvent(AWNSER_TOPIC_PREFIX+"12345", nil))
+	if published.Offset != 0 {
+		t.Error("the journal must not modify the event of the publisher")
+	}
+
+	topics := make([]string, 0)
+	eventSystem.currentJournal().scan(func(entry *journalEntry) {
+		topics = append(topics, entry.Event.Topic)
+	})
+	if len(topics) != 1 || topics[0] != "journal::copied" {
+		t.Errorf("expected only journal::copied to be journaled, got %v", topics)
+	}
+}
+
+func TestJournalRotation(t *testing.T) {
+	filename := os.TempDir() + "/susi-journal-rotation-test.json"
+	defer func(maxSize, segments string) {
+		*journalMaxSize, *journalSegments = maxSize, segments
+	}(*journalMaxSize, *journalSegments)
+	*journalMaxSize, *journalSegments = "200", "2"
+	for i := 0; i <= 3; i++ {
+		os.Remove(filename + "." + strconv.Itoa(i))
+		defer os.Remove(filename + "." + strconv.Itoa(i))
+	}
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	if err := EnableJournal(filename, []string{"rotation::#"}); err != nil {
+		t.Fatal(err)
+	}
+	defer disableJournal()
+	for i := 0; i < 20; i++ {
+		Publish(NewEvent("rotation::test", i))
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Error("expected only two rotated segments to be kept")
+	}
+	info, err := os.Stat(filename)
+	if err != nil || info.Size() >= 200 {
+		t.Errorf("expected the journal to be rotated, got %v", info)
+	}
+
+	//the kept segments are replayed in order
+	journal := eventSystem.currentJournal()
+	var last uint64
+	count := 0
+	journal.scan(func(entry *journalEntry) {
+		if entry.Offset <= last {
+			t.Errorf("offset %v after %v", entry.Offset, last)
+		}
+		last = entry.Offset
+		count++
+	})
+	if count == 0 || count >= 20 || last != journal.currentOffset()-1 {
+		t.Errorf("expected the newest events of the kept segments, got %v up to %v", count, last)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+Payloads published from Go are Go values, payloads from js, tcp or http are
+decoded json (map[string]interface{}, float64...). Topics can register a named
+payload schema, then every payload is decoded into the registered Go type
+before it is published, so subscribers see the same type regardless of the source.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+)
+
+type PayloadCodec interface {
+	Name() string
+	//Decode converts a payload into the canonical Go value of the schema
+	Decode(payload interface{}) (interface{}, error)
+	//Encode converts a payload into plain json values (maps, slices, float64...)
+	Encode(payload interface{}) (interface{}, error)
+}
+
+/*
+Returned by TryPublish if the payload does not fit the schema of the topic.
+*/
+type PayloadError struct {
+	Topic  string
+	Schema string
+	Reason string
+}
+
+func (err *PayloadError) Error() string {
+	return "payload of " + err.Topic + " does not match schema " + err.Schema + ": " + err.Reason
+}
+
+type payloadSchema struct {
+	Pattern string
+	Codec   PayloadCodec
+}
+
+var payloadSchemas struct {
+	sync.RWMutex
+	schemas []*payloadSchema
+}
+
+/*
+RegisterPayload registers a codec for all topics matching pattern.
+If multiple patterns match a topic, the first registered one wins.
+*/
+func RegisterPayload(pattern string, codec PayloadCodec) {
+	payloadSchemas.Lock()
+	defer payloadSchemas.Unlock()
+	payloadSchemas.schemas = append(payloadSchemas.schemas, &payloadSchema{pattern, codec})
+}
+
+func PayloadCodecFor(topic string) PayloadCodec {
+	payloadSchemas.RLock()
+	defer payloadSchemas.RUnlock()
+	for _, schema := range payloadSchemas.schemas {
+		if Match(schema.Pattern, topic) {
+			return schema.Codec
+		}
+	}
+	return nil
+}
+
+/*
+Returns the name of the payload schema of a topic, or "" if there is none.
+*/
+func PayloadSchema(topic string) string {
+	if codec := PayloadCodecFor(topic); codec != nil {
+		return codec.Name()
+	}
+	return ""
+}
+
+func DecodePayload(topic string, payload interface{}) (interface{}, error) {
+	codec := PayloadCodecFor(topic)
+	if codec == nil || payload == nil {
+		return payload, nil
+	}
+	decoded, err := codec.Decode(payload)
+	if err != nil {
+		return nil, &PayloadError{topic, codec.Name(), err.Error()}
+	}
+	return decoded, nil
+}
+
+func EncodePayload(topic string, payload interface{}) (interface{}, error) {
+	codec := PayloadCodecFor(topic)
+	if codec == nil || payload == nil {
+		return payload, nil
+	}
+	return codec.Encode(payload)
+}
+
+/*
+TypeCodec decodes payloads into the type of a prototype value, using a json
+round trip for payloads of another type.
+*/
+type TypeCodec struct {
+	name string
+	Type reflect.Type
+}
+
+func NewTypeCodec(name string, prototype interface{}) *TypeCodec {
+	return &TypeCodec{
+		name: name,
+		Type: reflect.TypeOf(prototype),
+	}
+}
+
+func (codec *TypeCodec) Name() string {
+	return codec.name
+}
+
+func (codec *TypeCodec) Decode(payload interface{}) (interface{}, error) {
+	if reflect.TypeOf(payload) == codec.Type {
+		return payload, nil
+	}
+	target := reflect.New(codec.Type)
+	if err := DecodeAs(payload, target.Interface()); err != nil {
+		return nil, err
+	}
+	return target.Elem().Interface(), nil
+}
+
+func (codec *TypeCodec) Encode(payload interface{}) (interface{}, error) {
+	marshaled, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var encoded interface{}
+	err = json.Unmarshal(marshaled, &encoded)
+	return encoded, err
+}
+
+/*
+DecodeAs stores payload in the value target points to. Payloads of the target
+type are copied directly, everything else is converted via json. This is handy
+for awnsers of events.Request, whose type depends on where the awnser came from.
+*/
+func DecodeAs(payload interface{}, target interface{}) error {
+	targetVal := reflect.ValueOf(target)
+	if targetVal.Kind() != reflect.Ptr || targetVal.IsNil() {
+		return errors.New("DecodeAs needs a non-nil pointer as target")
+	}
+	payloadVal := reflect.ValueOf(payload)
+	if payloadVal.IsValid() {
+		if payloadVal.Type() == targetVal.Type() && !payloadVal.IsNil() {
+			targetVal.Elem().Set(payloadVal.Elem())
+			return nil
+		}
+		if payloadVal.Type() == targetVal.Elem().Type() {
+			targetVal.Elem().Set(payloadVal)
+			return nil
+		}
+	}
+	marshaled, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(marshaled, target)
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"testing"
+)
+
+type payloadSample struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestTypedPayloads(t *testing.T) {
+	RegisterPayload("payload::typed", NewTypeCodec("sample", &payloadSample{}))
+	ch, closeChan := Subscribe("payload::typed", 0)
+	defer func() { closeChan <- true }()
+
+	//once from go, once as decoded json like it arrives from the network
+	Publish(NewEvent("payload::typed", &payloadSample{"go", 1}))
+	Publish(NewEvent("payload::typed", map[string]interface{}{"name": "json", "count": float64(2)}))
+
+	for _, expected := range []payloadSample{{"go", 1}, {"json", 2}} {
+		event := <-ch
+		sample, ok := event.Payload.(*payloadSample)
+		if !ok {
+			t.Errorf("expected *payloadSample, got %T", event.Payload)
+		} else if *sample != expected {
+			t.Errorf("expected %v, got %v", expected, *sample)
+		}
+	}
+
+	err := TryPublish(NewEvent("payload::typed", "not a sample"))
+	if _, ok := err.(*PayloadError); !ok {
+		t.Errorf("expected a PayloadError, got %v", err)
+	}
+}
+
+func TestDecodeAs(t *testing.T) {
+	var id uint64
+	if err := DecodeAs(float64(42), &id); err != nil || id != 42 {
+		t.Errorf("failed decoding float64 as uint64: %v %v", id, err)
+	}
+	sample := new(payloadSample)
+	if err := DecodeAs(&payloadSample{"foo", 3}, sample); err != nil || sample.Name != "foo" {
+		t.Errorf("failed copying payload of the target type: %v %v", sample, err)
+	}
+}
+
+func TestPayloadDecodedAfterInterception(t *testing.T) {
+	RegisterPayload("payload::intercepted", NewTypeCodec("sample", &payloadSample{}))
+	//like a js interceptor, which hands the payload back as plain json
+	RegisterInterceptor("payload-to-json", func(event *Event) error {
+		if event.Topic == "payload::intercepted" {
+			event.Payload = map[string]interface{}{"name": "js", "count": float64(4)}
+		}
+		return nil
+	})
+	defer UnregisterInterceptor("payload-to-json")
+	ch, closeChan := Subscribe("payload::intercepted", 0)
+	defer func() { closeChan <- true }()
+	Publish(NewEvent("payload::intercepted", &payloadSample{"go", 1}))
+	if sample, ok := (<-ch).Payload.(*payloadSample); !ok || sample.Name != "js" {
+		t.Errorf("expected the replaced payload as *payloadSample, got %v", sample)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+Publishes are queued in one of three lanes of their shard, so control topics like
+global::shutdown or session deletions never wait behind bulk data.
+An event uses its own Priority if set, otherwise the priority of its topic.
+Only Go code can set the Priority of an event, it is never read from json.
+*/
+
+import (
+	"sync"
+	"time"
+)
+
+type Priority uint8
+
+const (
+	PRIORITY_NORMAL Priority = iota
+	PRIORITY_CONTROL
+	PRIORITY_BULK
+)
+
+const QUEUES_TOPIC = "system::events::queues"
+
+func (priority Priority) String() string {
+	switch priority {
+	case PRIORITY_CONTROL:
+		return "control"
+	case PRIORITY_BULK:
+		return "bulk"
+	}
+	return "normal"
+}
+
+type topicPriority struct {
+	Pattern  string
+	Priority Priority
+}
+
+var topicPriorities = struct {
+	sync.RWMutex
+	priorities []*topicPriority
+}{
+	priorities: []*topicPriority{
+		{"global::shutdown", PRIORITY_CONTROL},
+		{"session::#", PRIORITY_CONTROL},
+		{"authentification::#", PRIORITY_CONTROL},
+		{"controller::auth::#", PRIORITY_CONTROL},
+	},
+}
+
+/*
+SetTopicPriority sets the default priority of all topics matching pattern.
+Later calls take precedence over earlier ones.
+*/
+func SetTopicPriority(pattern string, priority Priority) {
+	topicPriorities.Lock()
+	defer topicPriorities.Unlock()
+	topicPriorities.priorities = append([]*topicPriority{{pattern, priority}}, topicPriorities.priorities...)
+}
+
+func priorityOf(event *Event) Priority {
+	if event.Priority != PRIORITY_NORMAL {
+		return event.Priority
+	}
+	topicPriorities.RLock()
+	defer topicPriorities.RUnlock()
+	for _, entry := range topicPriorities.priorities {
+		if Match(entry.Pattern, event.Topic) {
+			return entry.Priority
+		}
+	}
+	return PRIORITY_NORMAL
+}
+
+func (shard *shard) lane(priority Priority) chan *command {
+	switch priority {
+	case PRIORITY_CONTROL:
+		return shard.controlChan
+	case PRIORITY_BULK:
+		return shard.bulkChan
+	}
+	return shard.cmdChan
+}
+
+/*
+How long publishes of one priority class waited in their lane.
+*/
+type QueueStat struct {
+	Count     uint64        `json:"count"`
+	TotalWait time.Duration `json:"totalwait"`
+	MaxWait   time.Duration `json:"maxwait"`
+}
+
+func (eventSystem *EventSystem) measureQueueWait(cmd *command) {
+	wait := time.Since(cmd.Enqueued)
+	eventSystem.statsLock.Lock()
+	defer eventSystem.statsLock.Unlock()
+	priority := cmd.Event.Priority
+	stat, ok := eventSystem.queueStats[priority]
+	if !ok {
+		stat = new(QueueStat)
+		eventSystem.queueStats[priority] = stat
+	}
+	stat.Count++
+	stat.TotalWait += wait
+	if wait > stat.MaxWait {
+		stat.MaxWait = wait
+	}
+}
+
+func (eventSystem *EventSystem) queueCounters() map[string]QueueStat {
+	eventSystem.statsLock.Lock()
+	defer eventSystem.statsLock.Unlock()
+	stats := make(map[string]QueueStat, len(eventSystem.queueStats))
+	for priority, stat := range eventSystem.queueStats {
+		stats[priority.String()] = *stat
+	}
+	return stats
+}
+
+/*
+Answers requests on QUEUES_TOPIC with the QueueStat of each priority class.
+*/
+func serveQueueStats(ch chan *Event) {
+	for event := range ch {
+		Awnser(event, eventSystem.queueCounters())
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTopicPriorities(t *testing.T) {
+	SetTopicPriority("telemetry::#", PRIORITY_BULK)
+	if priority := priorityOf(NewEvent("telemetry::cpu", nil)); priority != PRIORITY_BULK {
+		t.Errorf("expected bulk priority, got %v", priority)
+	}
+	if priority := priorityOf(NewEvent("session::del", nil)); priority != PRIORITY_CONTROL {
+		t.Errorf("expected control priority, got %v", priority)
+	}
+	event := NewEvent("telemetry::cpu", nil)
+	event.Priority = PRIORITY_CONTROL
+	if priority := priorityOf(event); priority != PRIORITY_CONTROL {
+		t.Errorf("expected explicit priority to win, got %v", priority)
+	}
+}
+
+func TestPriorityIsNotReadFromJSON(t *testing.T) {
+	event := new(Event)
+	if err := json.Unmarshal([]byte(`{"topic":"telemetry::cpu","priority":1}`), event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Priority != PRIORITY_NORMAL {
+		t.Errorf("clients must not choose the lane, got %v", event.Priority)
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	SetTopicPriority("telemetry::#", PRIORITY_BULK)
+	ch, closeChan := Subscribe("telemetry::load", 0)
+	defer func() { closeChan <- true }()
+	Publish(NewEvent("telemetry::load", 1))
+	<-ch
+	stats, err := Request(QUEUES_TOPIC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := stats.(map[string]QueueStat)["bulk"]; stat.Count == 0 {
+		t.Errorf("expected bulk publishes to be counted, got %+v", stat)
+	}
+}
@@ -13,38 +13,170 @@ package events
 
 import (
 	"path/filepath"
+	"time"
 )
 
 /*
-Global publish function
+Global publish function.
+If the event is flagged with Retain, the event system keeps it as last value of
+its topic and delivers it to every new subscriber of that topic. Publishing a
+retained event with a nil payload clears the retained value.
 */
 func Publish(event *Event) bool {
+	return TryPublish(event) == nil
+}
+
+/*
+Like Publish, but tells why an event was not delivered: an *AccessDeniedError
+if the ACL or the permissions forbid publishing to the topic (checked again
+for the new topic if an interceptor rerouted the event), a *RateLimitError
+if the publisher exceeded a rate limit, a *PayloadError if the payload
+does not fit the schema of the topic, a *RejectedError if an interceptor
+rejected it, or a *NoSubscribersError if nobody is subscribed.
+Rejections are also reported to the ReturnAddr of the event, and all failures
+but rate limits are dead lettered if dead letters are enabled.
+*/
+func TryPublish(event *Event) error {
+	if event.TraceId == 0 {
+		event.TraceId = event.Id
+	}
+	if err := checkPublish(event); err != nil {
+		return err
+	}
+	if err := rateLimit(event); err != nil {
+		AwnserError(event, err.Error())
+		return err
+	}
+	if err := decodePayload(event); err != nil {
+		return err
+	}
+	topic, authlevel := event.Topic, event.AuthLevel
+	if err := intercept(event); err != nil {
+		AwnserError(event, err.Error())
+		DeadLetter(event, DEADLETTER_REJECTED, err.Error())
+		return err
+	}
+	//an interceptor may have rerouted the event
+	if event.Topic != topic || event.AuthLevel != authlevel {
+		if err := checkPublish(event); err != nil {
+			return err
+		}
+	}
+	//interceptors may have replaced the payload by a plain json value or moved the event to another schema
+	if err := decodePayload(event); err != nil {
+		return err
+	}
+	event.Priority = priorityOf(event)
 	command := &command{
-		Type:   PUBLISH,
-		Event:  event,
-		Result: make(chan interface{}),
+		Event:    event,
+		Enqueued: time.Now(),
+		Result:   make(chan publishResult),
 	}
-	eventSystem.cmdChan <- command
-	res := (<-command.Result).(bool)
-	return res
+	eventSystem.shardFor(event.Topic).lane(event.Priority) <- command
+	if result := <-command.Result; !result.Found {
+		if result.Denied {
+			DeadLetter(event, DEADLETTER_UNAUTHORIZED, "authlevel or acl forbids all subscribers")
+		} else {
+			DeadLetter(event, DEADLETTER_UNROUTABLE, "nobody is subscribed")
+		}
+		return &NoSubscribersError{event.Topic}
+	}
+	return nil
 }
 
-func (eventSystem *EventSystem) publish(event *Event) bool {
-	found := false
-	for _, subscription := range eventSystem.globs {
-		if ok, err := filepath.Match(subscription.Glob, event.Topic); ok && (err == nil) {
-			if subscription.AuthLevel <= event.AuthLevel {
-				subscription.EventChan <- event
-				found = true
+func checkPublish(event *Event) error {
+	if !CanPublish(event.Topic, event.Username, event.Roles, event.AuthLevel) {
+		err := &AccessDeniedError{"publish to", event.Topic}
+		AwnserError(event, err.Error())
+		DeadLetter(event, DEADLETTER_UNAUTHORIZED, err.Error())
+		return err
+	}
+	return nil
+}
+
+func decodePayload(event *Event) error {
+	payload, err := DecodePayload(event.Topic, event.Payload)
+	if err != nil {
+		AwnserError(event, err.Error())
+		DeadLetter(event, DEADLETTER_REJECTED, err.Error())
+		return err
+	}
+	event.Payload = payload
+	return nil
+}
+
+/*
+Denied tells that there were subscribers, but the authlevel of the event or
+the ACL of the topic kept it from all of them.
+*/
+type publishResult struct {
+	Found  bool
+	Denied bool
+}
+
+/*
+publish runs in the dispatcher goroutine of the shard which owns the topic of the event.
+*/
+func (eventSystem *EventSystem) publish(shard *shard, event *Event) (result publishResult) {
+	if journal := eventSystem.currentJournal(); journal != nil && journal.matches(event.Topic) {
+		event = journal.append(event)
+	}
+	var patterns *patternSnapshot
+	var subs []*subscription
+	if event.Retain {
+		//a new subscription gets the event either from deliverRetained or from
+		//the snapshots loaded here, so it neither misses the event nor gets it twice
+		eventSystem.retainedLock.Lock()
+		if event.Payload == nil {
+			delete(eventSystem.retained, event.Topic)
+		} else {
+			eventSystem.retained[event.Topic] = event
+		}
+		patterns, subs = eventSystem.currentPatterns(), shard.current()[event.Topic]
+		eventSystem.retainedLock.Unlock()
+	} else {
+		patterns, subs = eventSystem.currentPatterns(), shard.current()[event.Topic]
+	}
+	result.Found = event.Retain
+	targets := make([]*subscription, 0, 8)
+	//the payload is prepared for filters only once, and only if a filter needs it
+	var view interface{}
+	viewed := false
+	grant := subscribeGrant(event.Topic)
+	consider := func(subscription *subscription) {
+		if !subscription.permits(event, grant) {
+			result.Denied = true
+			return
+		}
+		//an event filtered out was still routed, the subscriber just did not want it
+		result.Found = true
+		if subscription.Filter != nil {
+			if !viewed {
+				view, viewed = filterView(event.Payload), true
+			}
+			if !subscription.Filter.matchView(view) {
+				return
 			}
 		}
+		targets = append(targets, subscription)
 	}
-	subscriptions := eventSystem.topics[event.Topic]
-	for _, subscription := range subscriptions {
-		if subscription.AuthLevel <= event.AuthLevel {
-			subscription.EventChan <- event
-			found = true
+	for _, subscription := range patterns.globs {
+		if ok, err := filepath.Match(subscription.Glob, event.Topic); ok && (err == nil) {
+			consider(subscription)
 		}
 	}
-	return found
+	for _, subscription := range patterns.wildcards.match(event.Topic) {
+		consider(subscription)
+	}
+	for _, subscription := range subs {
+		consider(subscription)
+	}
+	shard.count(event.Topic, eventSystem.deliverTargets(targets, event))
+	return result
+}
+
+func ClearRetained(topic string) {
+	eventSystem.retainedLock.Lock()
+	defer eventSystem.retainedLock.Unlock()
+	delete(eventSystem.retained, topic)
 }
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+Rate limits protect the event system from publishers which flood it. Every
+limit is a token bucket for the topics matching its pattern, refilled with
+rate events per second and holding at most burst events. A limit counts per
+topic, per session or per user, so one client can not use up the quota of
+the others. An event must pass all limits matching its topic; events without
+a session (or user) are not counted by limits per session (or per user).
+In the config (events.cfg):
+	{"ratelimits": [
+		{"topic": "*", "per": "session", "rate": 50, "burst": 100},
+		{"topic": "firebird::query", "per": "user", "rate": 2}
+	]}
+Events over the limit are refused with a *RateLimitError and counted per
+topic (all awnser topics share one counter); the counters are answered on
+RATELIMITED_TOPIC. Events with authlevel 0 come from the system itself and
+are never limited.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const RATELIMITED_TOPIC = "system::events::ratelimited"
+
+const (
+	RATELIMIT_TOPIC   = "topic"
+	RATELIMIT_SESSION = "session"
+	RATELIMIT_USER    = "user"
+)
+
+type RateLimit struct {
+	Topic string  `json:"topic"`
+	Per   string  `json:"per"`
+	Rate  float64 `json:"rate"`
+	//defaults to rate, but at least one event
+	Burst float64 `json:"burst"`
+}
+
+/*
+Returned by TryPublish if the publisher exceeded a rate limit.
+*/
+type RateLimitError struct {
+	Topic string
+	Per   string
+}
+
+func (err *RateLimitError) Error() string {
+	return "rate limit per " + err.Per + " exceeded for " + err.Topic
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type bucketKey struct {
+	rule  int
+	scope string
+}
+
+// buckets which are full again are forgotten once there are this many
+const maxIdleBuckets = 4096
+
+var rateLimiter = struct {
+	sync.Mutex
+	rules   []*RateLimit
+	buckets map[bucketKey]*tokenBucket
+	limited map[string]uint64
+}{
+	buckets: make(map[bucketKey]*tokenBucket),
+	limited: make(map[string]uint64),
+}
+
+/*
+SetRateLimits replaces all limits and refills all buckets, nil removes the limits.
+*/
+func SetRateLimits(limits []*RateLimit) error {
+	for _, limit := range limits {
+		switch limit.Per {
+		case RATELIMIT_TOPIC, RATELIMIT_SESSION, RATELIMIT_USER:
+		default:
+			return errors.New("no such rate limit scope: " + limit.Per)
+		}
+		if limit.Rate <= 0 {
+			return errors.New("rate limit for " + limit.Topic + " needs a positive rate")
+		}
+		if limit.Burst < 1 {
+			limit.Burst = limit.Rate
+			if limit.Burst < 1 {
+				limit.Burst = 1
+			}
+		}
+	}
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+	rateLimiter.rules = limits
+	rateLimiter.buckets = make(map[bucketKey]*tokenBucket)
+	return nil
+}
+
+/*
+LoadRateLimits sets the limits from their config representation, usually
+state.Get("events.ratelimits"). A nil config removes the limits.
+*/
+func LoadRateLimits(config interface{}) error {
+	if config == nil {
+		return SetRateLimits(nil)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var limits []*RateLimit
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return err
+	}
+	return SetRateLimits(limits)
+}
+
+func rateLimitScope(limit *RateLimit, event *Event) string {
+	switch limit.Per {
+	case RATELIMIT_SESSION:
+		{
+			if event.SessionId == 0 {
+				return ""
+			}
+			return strconv.FormatUint(event.SessionId, 10)
+		}
+	case RATELIMIT_USER:
+		{
+			return event.Username
+		}
+	}
+	return event.Topic
+}
+
+/*
+rateLimit takes a token from every bucket the event counts against, or
+none at all if one of them is empty.
+*/
+func rateLimit(event *Event) error {
+	if event.AuthLevel == 0 {
+		return nil
+	}
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+	if len(rateLimiter.rules) == 0 {
+		return nil
+	}
+	now := time.Now()
+	var buckets []*tokenBucket
+	for idx, limit := range rateLimiter.rules {
+		if !Match(limit.Topic, event.Topic) {
+			continue
+		}
+		scope := rateLimitScope(limit, event)
+		if scope == "" {
+			continue
+		}
+		key := bucketKey{idx, scope}
+		bucket, ok := rateLimiter.buckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: limit.Burst}
+			rateLimiter.buckets[key] = bucket
+		} else {
+			bucket.tokens += now.Sub(bucket.updated).Seconds() * limit.Rate
+			if bucket.tokens > limit.Burst {
+				bucket.tokens = limit.Burst
+			}
+		}
+		bucket.updated = now
+		if bucket.tokens < 1 {
+			rateLimiter.limited[trackedTopic(rateLimiter.limited, event.Topic)]++
+			return &RateLimitError{event.Topic, limit.Per}
+		}
+		buckets = append(buckets, bucket)
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	if len(rateLimiter.buckets) > maxIdleBuckets {
+		pruneBuckets(now)
+	}
+	return nil
+}
+
+func pruneBuckets(now time.Time) {
+	for key, bucket := range rateLimiter.buckets {
+		limit := rateLimiter.rules[key.rule]
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*limit.Rate >= limit.Burst {
+			delete(rateLimiter.buckets, key)
+		}
+	}
+}
+
+func rateLimitedCounters() map[string]uint64 {
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+	counters := make(map[string]uint64, len(rateLimiter.limited))
+	for topic, count := range rateLimiter.limited {
+		counters[topic] = count
+	}
+	return counters
+}
+
+/*
+Answers requests on RATELIMITED_TOPIC with the number of refused events per topic.
+*/
+func serveRateLimitedCounters(ch chan *Event) {
+	for event := range ch {
+		Awnser(event, rateLimitedCounters())
+	}
+}
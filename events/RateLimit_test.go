@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	err := LoadRateLimits([]interface{}{
+		map[string]interface{}{"topic": "ratelimit::*", "per": "session", "rate": 50, "burst": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetRateLimits(nil)
+	//the refused events are counted per topic for good, so every run gets its own
+	topic := "ratelimit::flood" + strconv.FormatUint(NextId(), 10)
+	ch, closeChan := Subscribe(topic, 0)
+	defer func() { closeChan <- true }()
+
+	publish := func(session uint64) error {
+		event := NewEvent(topic, nil)
+		event.SessionId = session
+		return TryPublish(event)
+	}
+	for i := 0; i < 2; i++ {
+		if err := publish(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := publish(1).(*RateLimitError); !ok {
+		t.Error("expected the third event of the burst to be refused")
+	}
+	if err := publish(2); err != nil {
+		t.Error("other sessions have their own bucket: ", err)
+	}
+	if err := publish(0); err != nil {
+		t.Error("events without session are not limited per session: ", err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if err := publish(1); err != nil {
+		t.Error("the bucket should have been refilled: ", err)
+	}
+	if len(ch) != 5 {
+		t.Errorf("expected 5 delivered events, got %v", len(ch))
+	}
+	if rateLimitedCounters()[topic] != 1 {
+		t.Error("expected one refused event to be counted")
+	}
+	if err := SetRateLimits([]*RateLimit{{Topic: "*", Per: "planet", Rate: 1}}); err == nil {
+		t.Error("expected unknown scopes to be rejected")
+	}
+}
+
+func TestRateLimitExemptions(t *testing.T) {
+	err := SetRateLimits([]*RateLimit{{Topic: "*", Per: RATELIMIT_TOPIC, Rate: 0.001, Burst: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetRateLimits(nil)
+	before := rateLimitedCounters()[AWNSER_TOPIC_PREFIX+"*"]
+	system := "ratelimit::system::" + strconv.FormatUint(NextId(), 10)
+	for i := 0; i < 3; i++ {
+		event := NewEvent(system, nil)
+		event.AuthLevel = 0
+		if _, ok := TryPublish(event).(*RateLimitError); ok {
+			t.Error("events of the system must not be rate limited")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		topic := AWNSER_TOPIC_PREFIX + strconv.FormatUint(NextId(), 10)
+		ch, closeChan := Subscribe(topic, 0)
+		first, second := NewEvent(topic, nil), NewEvent(topic, nil)
+		TryPublish(first)
+		if _, ok := TryPublish(second).(*RateLimitError); !ok {
+			t.Error("expected the second event to the topic to be refused")
+		}
+		closeChan <- true
+		for _ = range ch {
+		}
+	}
+	counters := rateLimitedCounters()
+	if counters[AWNSER_TOPIC_PREFIX+"*"]-before != 3 {
+		t.Errorf("expected all awnser topics to share one counter, got %v", counters)
+	}
+	for topic := range counters {
+		if topic != AWNSER_TOPIC_PREFIX+"*" && strings.HasPrefix(topic, AWNSER_TOPIC_PREFIX) {
+			t.Errorf("unexpected counter for %v", topic)
+		}
+	}
+}
@@ -12,20 +12,87 @@
 package events
 
 import (
+	"context"
 	"errors"
+	"flag"
+	"log"
 	"strconv"
 	"time"
 )
 
+var requestTimeout = flag.String("events.requesttimeout", "30", "how many seconds events.Request waits for an awnser (0 waits forever)")
+
+/*
+The timeout used by Request. It is read from the events.requesttimeout flag in Go().
+*/
+var DefaultRequestTimeout time.Duration
+
+func parseRequestTimeout() time.Duration {
+	seconds, err := strconv.ParseInt(*requestTimeout, 10, 64)
+	if err != nil {
+		log.Print(err)
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/*
+Requests subscribe to a fresh topic with this prefix for their awnser.
+*/
+const AWNSER_TOPIC_PREFIX = "result"
+
+/*
+Returned by RequestContext if nobody is subscribed to the requested topic.
+*/
+type NoSubscribersError struct {
+	Topic string
+}
+
+func (err *NoSubscribersError) Error() string {
+	return "nobody is subscribed to " + err.Topic
+}
+
 func Request(topic string, payload interface{}) (interface{}, error) {
-	awnserTopic := "result" + strconv.Itoa(int(time.Now().UnixNano()))
+	ctx := context.Background()
+	if DefaultRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+	return RequestContext(ctx, topic, payload)
+}
+
+/*
+Like Request, but gives up when ctx is done. It fails immediately with the
+error of TryPublish if the request could not be delivered to anyone.
+If ctx carries an event (see ContextWithEvent), the request continues its trace.
+*/
+func RequestContext(ctx context.Context, topic string, payload interface{}) (interface{}, error) {
+	awnserTopic := AWNSER_TOPIC_PREFIX + strconv.FormatUint(NextId(), 10)
 	awnserChan, closeChan := Subscribe(awnserTopic, 0)
 	defer func() { closeChan <- true }()
-	event := NewEvent(topic, payload)
+	event := NewChildEvent(EventFromContext(ctx), topic, payload)
 	event.AuthLevel = 0
 	event.ReturnAddr = awnserTopic
-	Publish(event)
-	awnserEvent := <-awnserChan
+	if err := TryPublish(event); err != nil {
+		return nil, err
+	}
+	select {
+	case awnserEvent, ok := <-awnserChan:
+		{
+			if !ok {
+				return nil, errors.New("the subscription to " + awnserTopic + " was closed")
+			}
+			return parseAwnser(awnserEvent)
+		}
+	case <-ctx.Done():
+		{
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func parseAwnser(awnserEvent *Event) (interface{}, error) {
 	if dataMap, ok := awnserEvent.Payload.(map[string]interface{}); ok {
 		err, ok1 := dataMap["error"].(bool)
 		data, ok2 := dataMap["data"]
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+type RequestAllOptions struct {
+	//How long to collect awnsers, defaults to DefaultRequestTimeout
+	Timeout time.Duration
+	//Stop collecting after this many awnsers, 0 collects until the timeout
+	Expected int
+}
+
+type RequestResult struct {
+	Responder string
+	Data      interface{}
+	Error     error
+}
+
+/*
+RequestAll publishes a request and collects every awnser on its result topic,
+until the timeout is reached or the expected number of awnsers arrived.
+This is meant for polling all engines or all nodes (via "*@all" topics) at once.
+*/
+func RequestAll(topic string, payload interface{}, options RequestAllOptions) ([]*RequestResult, error) {
+	return RequestAllContext(context.Background(), topic, payload, options)
+}
+
+/*
+Like RequestAll, but also stops when ctx is done, returning the awnsers
+collected so far with the error of ctx. If ctx carries an event (see
+ContextWithEvent), the request continues its trace.
+*/
+func RequestAllContext(ctx context.Context, topic string, payload interface{}, options RequestAllOptions) ([]*RequestResult, error) {
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = DefaultRequestTimeout
+	}
+	if timeout == 0 && options.Expected == 0 {
+		return nil, errors.New("RequestAll needs a timeout or an expected number of awnsers")
+	}
+	awnserTopic := AWNSER_TOPIC_PREFIX + strconv.FormatUint(NextId(), 10)
+	awnserChan, closeChan := Subscribe(awnserTopic, 0)
+	defer func() { closeChan <- true }()
+	event := NewChildEvent(EventFromContext(ctx), topic, payload)
+	event.AuthLevel = 0
+	event.ReturnAddr = awnserTopic
+	if err := TryPublish(event); err != nil {
+		return nil, err
+	}
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timeoutChan = time.After(timeout)
+	}
+	results := make([]*RequestResult, 0)
+	for options.Expected == 0 || len(results) < options.Expected {
+		select {
+		case awnserEvent, ok := <-awnserChan:
+			{
+				if !ok {
+					return results, errors.New("the subscription to " + awnserTopic + " was closed")
+				}
+				data, err := parseAwnser(awnserEvent)
+				results = append(results, &RequestResult{
+					Responder: responderOf(awnserEvent),
+					Data:      data,
+					Error:     err,
+				})
+			}
+		case <-timeoutChan:
+			{
+				return results, nil
+			}
+		case <-ctx.Done():
+			{
+				return results, ctx.Err()
+			}
+		}
+	}
+	return results, nil
+}
+
+/*
+responderOf tells who sent an awnser. Awnsers without a responder are told
+apart by the session they were published in.
+*/
+func responderOf(awnserEvent *Event) string {
+	if dataMap, ok := awnserEvent.Payload.(map[string]interface{}); ok {
+		if responder, ok := dataMap["responder"].(string); ok && responder != "" {
+			return responder
+		}
+	}
+	if awnserEvent.SessionId != 0 {
+		return "session:" + strconv.FormatUint(awnserEvent.SessionId, 10)
+	}
+	return awnserEvent.Username
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+startResponders subscribes one responder per name to topic, the empty name
+awnsers with the identity of the node.
+*/
+func startResponders(topic string, names ...string) (requests chan *Event, stop func()) {
+	requests = make(chan *Event, 10)
+	closeChans := make([]chan bool, 0, len(names))
+	for _, name := range names {
+		ch, closeChan := Subscribe(topic, 0)
+		closeChans = append(closeChans, closeChan)
+		go func(name string) {
+			for event := range ch {
+				requests <- event
+				AwnserAs(name, event, name)
+			}
+		}(name)
+	}
+	return requests, func() {
+		for _, closeChan := range closeChans {
+			closeChan <- true
+		}
+	}
+}
+
+func TestRequestAllResponders(t *testing.T) {
+	topic := "requestall::poll::" + strconv.FormatUint(NextId(), 10)
+	requests, stop := startResponders(topic, "engine-a", "engine-b", "")
+	defer stop()
+
+	parent := NewEvent("requestall::cause", nil)
+	parent.TraceId = parent.Id
+	ctx := ContextWithEvent(context.Background(), parent)
+	results, err := RequestAllContext(ctx, topic, nil, RequestAllOptions{Timeout: time.Second, Expected: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	responders := make([]string, 0, len(results))
+	for _, result := range results {
+		if result.Error != nil {
+			t.Error(result.Error)
+		}
+		responders = append(responders, result.Responder)
+	}
+	sort.Strings(responders)
+	expected := []string{Identity, "engine-a@" + Identity, "engine-b@" + Identity}
+	sort.Strings(expected)
+	if len(responders) != 3 || responders[0] != expected[0] || responders[1] != expected[1] || responders[2] != expected[2] {
+		t.Errorf("expected the awnsers of %v, got %v", expected, responders)
+	}
+	if request := <-requests; request.TraceId != parent.TraceId || request.ParentId != parent.Id {
+		t.Errorf("expected the request to continue the trace of its parent, got %v", request)
+	}
+}
+
+func TestRequestAllTimeout(t *testing.T) {
+	topic := "requestall::timeout::" + strconv.FormatUint(NextId(), 10)
+	_, stop := startResponders(topic, "one", "two")
+	defer stop()
+
+	start := time.Now()
+	results, err := RequestAll(topic, nil, RequestAllOptions{Timeout: 100 * time.Millisecond, Expected: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected the two awnsers which arrived in time, got %v", len(results))
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected to wait for the timeout, waited %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := RequestAllContext(ctx, topic, nil, RequestAllOptions{Timeout: time.Second}); err != context.Canceled {
+		t.Errorf("expected the request to stop with its context, got %v", err)
+	}
+}
+
+func TestMarkResponder(t *testing.T) {
+	payload := map[string]interface{}{"error": false, "data": nil}
+	awnser := NewEvent(AWNSER_TOPIC_PREFIX+"1", payload)
+	MarkResponder(awnser, "session:7")
+	if responder := responderOf(awnser); responder != "session:7@"+Identity {
+		t.Errorf("expected the marked responder, got %v", responder)
+	}
+	if _, ok := payload["responder"]; ok {
+		t.Error("the map of the publisher must not be changed")
+	}
+	for _, topic := range []string{"requestall::plain", AWNSER_TOPIC_PREFIX + "s::foo", AWNSER_TOPIC_PREFIX + "set"} {
+		other := NewEvent(topic, map[string]interface{}{})
+		if MarkResponder(other, "session:7"); len(other.Payload.(map[string]interface{})) != 0 {
+			t.Errorf("only awnsers are marked, not %v", topic)
+		}
+	}
+}
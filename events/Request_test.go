@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRequestNoSubscribers(t *testing.T) {
+	topic := "request::nobody::" + strconv.FormatUint(NextId(), 10)
+	_, err := RequestContext(context.Background(), topic, nil)
+	if noSubscribers, ok := err.(*NoSubscribersError); !ok || noSubscribers.Topic != topic {
+		t.Errorf("expected a NoSubscribersError for %v, got %v", topic, err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	topic := "request::silent::" + strconv.FormatUint(NextId(), 10)
+	ch, closeChan := Subscribe(topic, 0)
+	defer func() { closeChan <- true }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := RequestContext(ctx, topic, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("the request did not give up at the deadline")
+	}
+	if len(ch) != 1 {
+		t.Error("expected the request to be delivered")
+	}
+}
+
+func TestRequestAwnser(t *testing.T) {
+	topic := "request::echo::" + strconv.FormatUint(NextId(), 10)
+	ch, closeChan := Subscribe(topic, 0)
+	defer func() { closeChan <- true }()
+	go func() {
+		for event := range ch {
+			Awnser(event, event.Payload)
+		}
+	}()
+	if data, err := RequestContext(context.Background(), topic, "ping"); err != nil || data != "ping" {
+		t.Errorf("expected the echo, got %v %v", data, err)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func publishRetained(topic string, payload interface{}) {
+	event := NewEvent(topic, payload)
+	event.Retain = true
+	Publish(event)
+}
+
+func TestRetain(t *testing.T) {
+	topic := "retain::lamp::" + strconv.FormatUint(NextId(), 10)
+	defer ClearRetained(topic)
+	publishRetained(topic, "off")
+	publishRetained(topic, "on")
+
+	ch, closeChan := Subscribe(topic, 0)
+	defer func() { closeChan <- true }()
+	if len(ch) != 1 {
+		t.Fatalf("expected exactly the last retained event, got %v events", len(ch))
+	}
+	if event := <-ch; event.Payload != "on" {
+		t.Errorf("expected the last retained value, got %v", event.Payload)
+	}
+
+	//a nil payload clears the retained value
+	publishRetained(topic, nil)
+	<-ch
+	late, closeLate := Subscribe(topic, 0)
+	defer func() { closeLate <- true }()
+	if len(late) != 0 {
+		t.Errorf("expected no retained event after clearing, got %v", <-late)
+	}
+}
+
+func TestRetainWildcard(t *testing.T) {
+	prefix := "retain::room" + strconv.FormatUint(NextId(), 10)
+	topics := []string{prefix + "::temp", prefix + "::humidity"}
+	for _, topic := range topics {
+		publishRetained(topic, topic)
+		defer ClearRetained(topic)
+	}
+	publishRetained("retain::elsewhere", "other")
+	defer ClearRetained("retain::elsewhere")
+
+	ch, closeChan := Subscribe(prefix+"::*", 0)
+	defer func() { closeChan <- true }()
+	received := make(map[string]bool)
+	for len(ch) > 0 {
+		received[(<-ch).Topic] = true
+	}
+	if len(received) != 2 || !received[topics[0]] || !received[topics[1]] {
+		t.Errorf("expected the retained events of %v, got %v", topics, received)
+	}
+}
+
+/*
+Subscribing while retained values are published must give every subscriber
+each value at most once, in order, ending with the last one.
+*/
+func TestRetainConcurrentSubscribe(t *testing.T) {
+	topic := "retain::race::" + strconv.FormatUint(NextId(), 10)
+	defer ClearRetained(topic)
+	const values = 200
+	publishRetained(topic, 0)
+
+	wg := sync.WaitGroup{}
+	errors := make(chan string, 100)
+	subscribe := func() {
+		defer wg.Done()
+		ch, closeChan := Subscribe(topic, 0)
+		defer func() { closeChan <- true }()
+		last := -1
+		for {
+			select {
+			case event := <-ch:
+				value := event.Payload.(int)
+				if value <= last {
+					errors <- "got " + strconv.Itoa(value) + " after " + strconv.Itoa(last)
+					return
+				}
+				if last = value; last == values {
+					return
+				}
+			case <-time.After(time.Second):
+				errors <- "missed the last value, got " + strconv.Itoa(last)
+				return
+			}
+		}
+	}
+	for i := 1; i <= values; i++ {
+		if i%5 == 0 {
+			wg.Add(1)
+			go subscribe()
+		}
+		publishRetained(topic, i)
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"flag"
+	"hash/fnv"
+	"log"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var shardCount = flag.String("events.shards", "0", "number of event dispatcher goroutines (0 uses one per cpu)")
+
+func parseShardCount() int {
+	count, err := strconv.Atoi(*shardCount)
+	if err != nil {
+		log.Print(err)
+		count = 0
+	}
+	if count <= 0 {
+		count = runtime.NumCPU()
+	}
+	return count
+}
+
+/*
+A shard owns the subscriptions to a part of the plain topics and dispatches all
+events published to them. All events of one topic go through the same shard,
+so they keep their order.
+*/
+type shard struct {
+	lock        sync.Mutex
+	topics      atomic.Value //map[string][]*subscription
+	cmdChan     chan *command
+	controlChan chan *command
+	bulkChan    chan *command
+	statsLock   sync.Mutex
+	published   map[string]uint64
+	delivered   map[string]uint64
+}
+
+func newShard() *shard {
+	shard := &shard{
+		cmdChan:     make(chan *command, 10),
+		controlChan: make(chan *command, 10),
+		bulkChan:    make(chan *command, 100),
+		published:   make(map[string]uint64),
+		delivered:   make(map[string]uint64),
+	}
+	shard.topics.Store(make(map[string][]*subscription))
+	return shard
+}
+
+func (eventSystem *EventSystem) shardFor(topic string) *shard {
+	hash := fnv.New32a()
+	hash.Write([]byte(topic))
+	return eventSystem.shards[hash.Sum32()%uint32(len(eventSystem.shards))]
+}
+
+func (shard *shard) current() map[string][]*subscription {
+	return shard.topics.Load().(map[string][]*subscription)
+}
+
+/*
+update replaces the subscriptions of one topic by a new slice. The map is
+copied, so dispatchers which still hold the old snapshot are not disturbed.
+*/
+func (shard *shard) update(topic string, fn func(subs []*subscription) []*subscription) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	old := shard.current()
+	topics := make(map[string][]*subscription, len(old)+1)
+	for key, subs := range old {
+		topics[key] = subs
+	}
+	if subs := fn(old[topic]); len(subs) > 0 {
+		topics[topic] = subs
+	} else {
+		delete(topics, topic)
+	}
+	shard.topics.Store(topics)
+}
+
+/*
+The backend always prefers the control lane, then the normal lane and only then bulk data.
+*/
+func (shard *shard) backend() {
+	for {
+		var cmd *command
+		select {
+		case cmd = <-shard.controlChan:
+		default:
+			select {
+			case cmd = <-shard.controlChan:
+			case cmd = <-shard.cmdChan:
+			default:
+				select {
+				case cmd = <-shard.controlChan:
+				case cmd = <-shard.cmdChan:
+				case cmd = <-shard.bulkChan:
+				}
+			}
+		}
+		eventSystem.measureQueueWait(cmd)
+		cmd.Result <- eventSystem.publish(shard, cmd.Event)
+	}
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+The event system counts what happens per topic: events published to it,
+deliveries to subscriptions, events dropped by full subscriptions and events
+refused by rate limits. Together with gauges for the number of subscribers,
+the events waiting in their channels and the commands waiting in the lanes
+of the shards, these are answered on STATS_TOPIC and written in the
+Prometheus text format by WritePrometheus.
+Awnser topics of requests are counted together as "result*". Publishers
+choose their topics freely, so every counter tracks at most
+events.stats.maxtopics topics and counts all further topics as
+STATS_OTHER_TOPIC. Reset drops all counters. Drops and subscribers are
+counted for the topic (or pattern) which was subscribed to.
+*/
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const STATS_TOPIC = "system::events::stats"
+
+const STATS_OTHER_TOPIC = "other"
+
+var statsMaxTopics = flag.String("events.stats.maxtopics", "1000", "how many topics each counter tracks, the others are counted as "+STATS_OTHER_TOPIC)
+
+var maxStatsTopics = 1000
+
+func parseStatsMaxTopics() int {
+	max, err := strconv.Atoi(*statsMaxTopics)
+	if err != nil || max <= 0 {
+		log.Print("invalid events.stats.maxtopics, using 1000")
+		max = 1000
+	}
+	return max
+}
+
+// how often publish rates are computed
+const STATS_SAMPLE_INTERVAL = 10 * time.Second
+
+type TopicStats struct {
+	Published   uint64 `json:"published"`
+	Delivered   uint64 `json:"delivered"`
+	Dropped     uint64 `json:"dropped"`
+	RateLimited uint64 `json:"ratelimited"`
+	Subscribers int    `json:"subscribers"`
+	QueueDepth  int    `json:"queuedepth"`
+	//events per second during the last STATS_SAMPLE_INTERVAL
+	PublishRate float64 `json:"publishrate"`
+}
+
+type LaneStats struct {
+	QueueStat
+	//commands waiting in the lane of all shards
+	Pending int `json:"pending"`
+}
+
+type Stats struct {
+	Topics      map[string]*TopicStats `json:"topics"`
+	Lanes       map[string]*LaneStats  `json:"lanes"`
+	Published   uint64                 `json:"published"`
+	Delivered   uint64                 `json:"delivered"`
+	Dropped     uint64                 `json:"dropped"`
+	Subscribers int                    `json:"subscribers"`
+}
+
+func GetStats() *Stats {
+	return eventSystem.stats()
+}
+
+func statsTopic(topic string) string {
+	if isAwnserTopic(topic) {
+		return AWNSER_TOPIC_PREFIX + "*"
+	}
+	return topic
+}
+
+/*
+trackedTopic returns the key topic is counted under in counters: its
+statsTopic, or STATS_OTHER_TOPIC if counters is full.
+*/
+func trackedTopic(counters map[string]uint64, topic string) string {
+	topic = statsTopic(topic)
+	if _, ok := counters[topic]; !ok && len(counters) >= maxStatsTopics {
+		return STATS_OTHER_TOPIC
+	}
+	return topic
+}
+
+/*
+count runs in the dispatcher goroutine of the shard.
+*/
+func (shard *shard) count(topic string, deliveries int) {
+	shard.statsLock.Lock()
+	defer shard.statsLock.Unlock()
+	topic = trackedTopic(shard.published, topic)
+	shard.published[topic]++
+	shard.delivered[topic] += uint64(deliveries)
+}
+
+func (eventSystem *EventSystem) publishedCounters() map[string]uint64 {
+	counters := make(map[string]uint64)
+	for _, shard := range eventSystem.shards {
+		shard.statsLock.Lock()
+		for topic, count := range shard.published {
+			counters[topic] += count
+		}
+		shard.statsLock.Unlock()
+	}
+	return counters
+}
+
+func (eventSystem *EventSystem) sampleRates(interval time.Duration) {
+	for range time.Tick(interval) {
+		counters := eventSystem.publishedCounters()
+		eventSystem.statsLock.Lock()
+		//idle topics have no rate
+		rates := make(map[string]float64)
+		for topic, count := range counters {
+			if count > eventSystem.lastCounts[topic] {
+				rates[topic] = float64(count-eventSystem.lastCounts[topic]) / interval.Seconds()
+			}
+		}
+		eventSystem.rates = rates
+		eventSystem.lastCounts = counters
+		eventSystem.statsLock.Unlock()
+	}
+}
+
+func (eventSystem *EventSystem) stats() *Stats {
+	stats := &Stats{
+		Topics: make(map[string]*TopicStats),
+		Lanes:  make(map[string]*LaneStats),
+	}
+	topic := func(name string) *TopicStats {
+		name = statsTopic(name)
+		topicStats, ok := stats.Topics[name]
+		if !ok {
+			topicStats = new(TopicStats)
+			stats.Topics[name] = topicStats
+		}
+		return topicStats
+	}
+	subscribed := func(sub *subscription) {
+		topicStats := topic(sub.Topic)
+		topicStats.Subscribers++
+		topicStats.QueueDepth += len(sub.EventChan)
+		stats.Subscribers++
+	}
+	priorities := []Priority{PRIORITY_NORMAL, PRIORITY_CONTROL, PRIORITY_BULK}
+	for _, priority := range priorities {
+		stats.Lanes[priority.String()] = new(LaneStats)
+	}
+	for _, shard := range eventSystem.shards {
+		shard.statsLock.Lock()
+		for name, count := range shard.published {
+			topic(name).Published += count
+			stats.Published += count
+		}
+		for name, count := range shard.delivered {
+			topic(name).Delivered += count
+			stats.Delivered += count
+		}
+		shard.statsLock.Unlock()
+		for _, subs := range shard.current() {
+			for _, sub := range subs {
+				subscribed(sub)
+			}
+		}
+		for _, priority := range priorities {
+			stats.Lanes[priority.String()].Pending += len(shard.lane(priority))
+		}
+	}
+	patterns := eventSystem.currentPatterns()
+	for _, sub := range patterns.globs {
+		subscribed(sub)
+	}
+	for _, sub := range patterns.wildcards.all() {
+		subscribed(sub)
+	}
+	for name, count := range eventSystem.droppedCounters() {
+		topic(name).Dropped += count
+		stats.Dropped += count
+	}
+	for name, count := range rateLimitedCounters() {
+		topic(name).RateLimited += count
+	}
+	for name, stat := range eventSystem.queueCounters() {
+		if lane, ok := stats.Lanes[name]; ok {
+			lane.QueueStat = stat
+		}
+	}
+	eventSystem.statsLock.Lock()
+	for name, rate := range eventSystem.rates {
+		if topicStats, ok := stats.Topics[name]; ok {
+			topicStats.PublishRate = rate
+		}
+	}
+	eventSystem.statsLock.Unlock()
+	return stats
+}
+
+func (eventSystem *EventSystem) resetStats() {
+	for _, shard := range eventSystem.shards {
+		shard.statsLock.Lock()
+		shard.published = make(map[string]uint64)
+		shard.delivered = make(map[string]uint64)
+		shard.statsLock.Unlock()
+	}
+	eventSystem.droppedLock.Lock()
+	eventSystem.dropped = make(map[string]uint64)
+	eventSystem.droppedLock.Unlock()
+	eventSystem.statsLock.Lock()
+	eventSystem.rates = make(map[string]float64)
+	eventSystem.lastCounts = make(map[string]uint64)
+	eventSystem.statsLock.Unlock()
+	rateLimiter.Lock()
+	rateLimiter.limited = make(map[string]uint64)
+	rateLimiter.Unlock()
+}
+
+/*
+Answers requests on STATS_TOPIC with the current Stats.
+*/
+func serveStats(ch chan *Event) {
+	for event := range ch {
+		Awnser(event, eventSystem.stats())
+	}
+}
+
+/*
+WritePrometheus writes the current stats in the Prometheus text format.
+*/
+func WritePrometheus(w io.Writer) error {
+	stats := eventSystem.stats()
+	buff := &bytes.Buffer{}
+	topics := make([]string, 0, len(stats.Topics))
+	for name := range stats.Topics {
+		topics = append(topics, name)
+	}
+	sort.Strings(topics)
+	perTopic := func(name, kind, help string, value func(topicStats *TopicStats) string) {
+		fmt.Fprintf(buff, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+		for _, topic := range topics {
+			fmt.Fprintf(buff, "%v{topic=\"%v\"} %v\n", name, prometheusLabel(topic), value(stats.Topics[topic]))
+		}
+	}
+	perTopic("susi_events_published_total", "counter", "Events published per topic.", func(topicStats *TopicStats) string {
+		return strconv.FormatUint(topicStats.Published, 10)
+	})
+	perTopic("susi_events_delivered_total", "counter", "Events delivered to subscriptions per topic.", func(topicStats *TopicStats) string {
+		return strconv.FormatUint(topicStats.Delivered, 10)
+	})
+	perTopic("susi_events_dropped_total", "counter", "Events dropped by full subscriptions per subscribed topic.", func(topicStats *TopicStats) string {
+		return strconv.FormatUint(topicStats.Dropped, 10)
+	})
+	perTopic("susi_events_ratelimited_total", "counter", "Events refused by rate limits per topic.", func(topicStats *TopicStats) string {
+		return strconv.FormatUint(topicStats.RateLimited, 10)
+	})
+	perTopic("susi_events_subscribers", "gauge", "Subscriptions per subscribed topic.", func(topicStats *TopicStats) string {
+		return strconv.Itoa(topicStats.Subscribers)
+	})
+	perTopic("susi_events_queue_depth", "gauge", "Events waiting in the channels of the subscriptions per subscribed topic.", func(topicStats *TopicStats) string {
+		return strconv.Itoa(topicStats.QueueDepth)
+	})
+	perTopic("susi_events_publish_rate", "gauge", "Events published per second and topic.", func(topicStats *TopicStats) string {
+		return strconv.FormatFloat(topicStats.PublishRate, 'g', -1, 64)
+	})
+	lanes := make([]string, 0, len(stats.Lanes))
+	for name := range stats.Lanes {
+		lanes = append(lanes, name)
+	}
+	sort.Strings(lanes)
+	fmt.Fprint(buff, "# HELP susi_events_lane_pending Publishes waiting in the lanes of the shards.\n# TYPE susi_events_lane_pending gauge\n")
+	for _, lane := range lanes {
+		fmt.Fprintf(buff, "susi_events_lane_pending{lane=\"%v\"} %v\n", lane, stats.Lanes[lane].Pending)
+	}
+	fmt.Fprint(buff, "# HELP susi_events_lane_wait_seconds_total Time publishes waited in the lanes of the shards.\n# TYPE susi_events_lane_wait_seconds_total counter\n")
+	for _, lane := range lanes {
+		fmt.Fprintf(buff, "susi_events_lane_wait_seconds_total{lane=\"%v\"} %v\n", lane, stats.Lanes[lane].TotalWait.Seconds())
+	}
+	_, err := w.Write(buff.Bytes())
+	return err
+}
+
+func prometheusLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
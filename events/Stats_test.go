@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	//the counters are never reset, so every run gets its own topics
+	prefix := "stats" + strconv.FormatUint(NextId(), 10)
+	name := prefix + "::topic"
+	ch1, close1 := Subscribe(name, 0)
+	defer func() { close1 <- true }()
+	_, close2 := Subscribe(prefix+"::*", 0)
+	defer func() { close2 <- true }()
+	for i := 0; i < 3; i++ {
+		Publish(NewEvent(name, nil))
+	}
+	stats := GetStats()
+	topic := stats.Topics[name]
+	if topic == nil || topic.Published != 3 || topic.Delivered != 6 {
+		t.Fatalf("expected 3 published and 6 delivered events, got %+v", topic)
+	}
+	if topic.Subscribers != 1 || topic.QueueDepth != len(ch1) || stats.Topics[prefix+"::*"].Subscribers != 1 {
+		t.Errorf("wrong gauges: %+v %+v", topic, stats.Topics[prefix+"::*"])
+	}
+	if _, ok := stats.Lanes[PRIORITY_NORMAL.String()]; !ok {
+		t.Error("expected lane stats")
+	}
+	if statsTopic("result123") != "result*" || statsTopic("results") != "results" {
+		t.Error("awnser topics should be counted together")
+	}
+
+	data, err := Request(STATS_TOPIC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answered, ok := data.(*Stats); !ok || answered.Topics[name] == nil {
+		t.Errorf("unexpected stats awnser: %T", data)
+	}
+
+	buff := &bytes.Buffer{}
+	if err := WritePrometheus(buff); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buff.String(), `susi_events_published_total{topic="`+name+`"} 3`) {
+		t.Errorf("missing published counter in:\n%v", buff.String())
+	}
+}
+
+func TestStatsTopicCap(t *testing.T) {
+	defer func(max int) { maxStatsTopics = max }(maxStatsTopics)
+	maxStatsTopics = 2
+	counters := map[string]uint64{"stats::a": 1}
+	for _, topic := range []string{"stats::b", "stats::c", "stats::a", "result42", "stats::d"} {
+		counters[trackedTopic(counters, topic)]++
+	}
+	expected := map[string]uint64{"stats::a": 2, "stats::b": 1, STATS_OTHER_TOPIC: 3}
+	if len(counters) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, counters)
+	}
+	for topic, count := range expected {
+		if counters[topic] != count {
+			t.Errorf("expected %v, got %v", expected, counters)
+		}
+	}
+}
@@ -12,6 +12,7 @@
 package events
 
 import (
+	"sync"
 	"time"
 )
 
@@ -19,85 +20,232 @@ import (
 Global subscribe function
 */
 func Subscribe(topic string, authlevel uint8) (eventChannel chan *Event, closeChannel chan bool) {
-	command := &command{
-		Type: SUBSCRIBE,
-		Event: &Event{
-			Topic:     topic,
-			AuthLevel: authlevel,
-		},
-		Result: make(chan interface{}),
+	return SubscribeWithOptions(topic, authlevel, SubscribeOptions{})
+}
+
+/*
+Options for a single subscription. The zero value behaves like Subscribe.
+*/
+type SubscribeOptions struct {
+	Policy BackpressurePolicy
+	//Replay journaled events starting at this offset (0 disables the replay)
+	FromOffset uint64
+	//Replay journaled events published after this time (zero disables the replay)
+	FromTime time.Time
+	//Share the events of the topic with the other subscriptions of this group
+	Group   string
+	Balance BalancePolicy
+	//Deliver only events whose payload matches (nil delivers everything)
+	Filter *Filter
+	//The user the ACL grants are checked for
+	Username string
+	//The roles permissions are checked for, empty means the roles authlevel maps to
+	Roles []string
+}
+
+func SubscribeWithOptions(topic string, authlevel uint8, options SubscribeOptions) (eventChannel chan *Event, closeChannel chan bool) {
+	return eventSystem.subscribe(topic, authlevel, &options)
+}
+
+/*
+Like SubscribeWithOptions, but fails with an *AccessDeniedError if the ACL or
+the permissions forbid subscribing to topic. Patterns are accepted, their events are checked
+one by one.
+*/
+func TrySubscribe(topic string, authlevel uint8, options SubscribeOptions) (eventChannel chan *Event, closeChannel chan bool, err error) {
+	if err := CheckSubscribe(topic, options.Username, options.Roles, authlevel); err != nil {
+		return nil, nil, err
 	}
-	eventSystem.cmdChan <- command
-	res_ := <-command.Result
-	res := res_.(subscribeResult)
-	eventChannel = res.EventChan
-	closeChannel = res.CloseChan
-	return
+	eventChannel, closeChannel = eventSystem.subscribe(topic, authlevel, &options)
+	return eventChannel, closeChannel, nil
 }
 
+/*
+CheckSubscribe is the check of TrySubscribe, for callers which subscribe
+later: plain topics are checked right away, patterns are always accepted
+because their events are checked one by one.
+*/
+func CheckSubscribe(topic, username string, roles []string, authlevel uint8) error {
+	if !isWildcard(topic) && !isGlob(topic) && !CanSubscribe(topic, username, roles, authlevel) {
+		return &AccessDeniedError{"subscribe to", topic}
+	}
+	return nil
+}
+
+/*
+The lock of a subscription guards the backlog and the closed flag. It is not
+held while a delivery blocks on a full channel; sending counts those
+deliveries instead, and done is closed first when the subscription closes, so
+they give up before the channel is closed.
+*/
 type subscription struct {
+	Id        uint64
 	Topic     string
 	Glob      string
 	AuthLevel uint8
+	Username  string
+	Roles     []string
+	Policy    BackpressurePolicy
+	Group     string
+	Balance   BalancePolicy
+	Filter    *Filter
 	EventChan chan *Event
+	lock      sync.Mutex
+	backlog   []*Event
+	closed    bool
+	sending   sync.WaitGroup
+	done      chan bool
+	doneOnce  sync.Once
+	//decisions of mayReceive, see ACL.go
+	permitLock    sync.Mutex
+	permitVersion permitVersion
+	permitted     map[string]bool
 }
 
-type subscribeResult struct {
-	EventChan chan *Event
-	CloseChan chan bool
-}
-
-func (ptr *EventSystem) subscribe(topic string, authlevel uint8) (eventChannel chan *Event, closeChannel chan bool) {
+func (ptr *EventSystem) subscribe(topic string, authlevel uint8, options *SubscribeOptions) (eventChannel chan *Event, closeChannel chan bool) {
 	eventChannel = make(chan *Event, 100)
 	closeChannel = make(chan bool)
-	id := uint64(time.Now().UnixNano())
-	if isGlob(topic) {
-		subscription := &subscription{
-			Glob:      topic,
-			EventChan: eventChannel,
-		}
-		ptr.globs[id] = subscription
+	id := NextId()
+	sub := &subscription{
+		Id:        id,
+		Topic:     topic,
+		EventChan: eventChannel,
+		AuthLevel: authlevel,
+		Username:  options.Username,
+		Roles:     options.Roles,
+		Policy:    options.Policy,
+		Group:     options.Group,
+		Balance:   options.Balance,
+		Filter:    options.Filter,
+		done:      make(chan bool),
+	}
+	journal := ptr.currentJournal()
+	replay := journal != nil && (options.FromOffset > 0 || !options.FromTime.IsZero())
+	if replay {
+		sub.backlog = make([]*Event, 0)
+	}
+	if sub.Group != "" {
+		joinGroup(sub)
+	}
+	//publishers of retained events wait until the subscription got the retained ones
+	ptr.retainedLock.RLock()
+	if isWildcard(topic) {
+		ptr.updatePatterns(func(patterns *patternSnapshot) {
+			patterns.wildcards.insert(topic, id, sub)
+		})
+	} else if isGlob(topic) {
+		sub.Glob = topic
+		ptr.updatePatterns(func(patterns *patternSnapshot) {
+			patterns.globs[id] = sub
+		})
 	} else {
-		subscriptionsMap := ptr.topics[topic]
-		if subscriptionsMap == nil {
-			tmp := make(map[uint64]*subscription)
-			ptr.topics[topic] = tmp
-			subscriptionsMap = tmp
-		}
-		subscription := &subscription{
-			Topic:     topic,
-			EventChan: eventChannel,
-			AuthLevel: authlevel,
-		}
-		subscriptionsMap[id] = subscription
+		ptr.shardFor(topic).update(topic, func(subs []*subscription) []*subscription {
+			result := make([]*subscription, len(subs), len(subs)+1)
+			copy(result, subs)
+			return append(result, sub)
+		})
+	}
+	ptr.deliverRetained(sub)
+	ptr.retainedLock.RUnlock()
+	if replay {
+		go journal.replay(sub, options, journal.currentOffset())
 	}
 	//log.Print("subscribed to ",topic," (",id,")")
 	go func() {
 		<-closeChannel
 		//log.Print("unsubscribed from ",topic," (",id,")")
-		ptr.cmdChan <- &command{
-			Type: UNSUBSCRIBE,
-			Event: &Event{
-				Topic:   topic,
-				Payload: id,
-			},
-		}
+		ptr.unsubscribe(topic, id)
 	}()
 	return eventChannel, closeChannel
 }
 
+/*
+updatePatterns copies the glob and wildcard subscriptions, lets fn modify the
+copy and publishes it as the new snapshot.
+*/
+func (eventSystem *EventSystem) updatePatterns(fn func(patterns *patternSnapshot)) {
+	eventSystem.patternLock.Lock()
+	defer eventSystem.patternLock.Unlock()
+	old := eventSystem.currentPatterns()
+	patterns := &patternSnapshot{
+		globs:     make(map[uint64]*subscription, len(old.globs)+1),
+		wildcards: old.wildcards.clone(),
+	}
+	for id, sub := range old.globs {
+		patterns.globs[id] = sub
+	}
+	fn(patterns)
+	eventSystem.patterns.Store(patterns)
+}
+
 func (eventSystem *EventSystem) unsubscribe(topic string, id uint64) {
-	if topic != "" {
-		if subscriptions, ok := eventSystem.topics[topic]; ok {
-			if subscription, ok := subscriptions[id]; ok {
-				close(subscription.EventChan)
+	var removed *subscription
+	if isWildcard(topic) {
+		eventSystem.updatePatterns(func(patterns *patternSnapshot) {
+			removed = patterns.wildcards.remove(topic, id)
+		})
+	} else if topic != "" && !isGlob(topic) {
+		eventSystem.shardFor(topic).update(topic, func(subs []*subscription) []*subscription {
+			result := make([]*subscription, 0, len(subs))
+			for _, sub := range subs {
+				if sub.Id == id {
+					removed = sub
+				} else {
+					result = append(result, sub)
+				}
 			}
-			delete(subscriptions, id)
-		}
+			return result
+		})
 	} else {
-		if subscription, ok := eventSystem.globs[id]; ok {
-			close(subscription.EventChan)
+		eventSystem.updatePatterns(func(patterns *patternSnapshot) {
+			removed = patterns.globs[id]
+			delete(patterns.globs, id)
+		})
+	}
+	if removed != nil {
+		if removed.Group != "" {
+			leaveGroup(removed)
+		}
+		removed.close()
+	}
+}
+
+func (sub *subscription) accepts(event *Event) bool {
+	return sub.Filter == nil || sub.Filter.Match(event.Payload)
+}
+
+func (sub *subscription) signalDone() {
+	sub.doneOnce.Do(func() { close(sub.done) })
+}
+
+func (sub *subscription) close() {
+	sub.signalDone()
+	sub.lock.Lock()
+	if sub.closed {
+		sub.lock.Unlock()
+		return
+	}
+	sub.closed = true
+	sub.lock.Unlock()
+	//deliveries only start sending while the subscription is open
+	sub.sending.Wait()
+	close(sub.EventChan)
+}
+
+/*
+The event channel of a new subscription is not read before Subscribe returns,
+so retained events must not block. It is called with the retainedLock held.
+*/
+func (eventSystem *EventSystem) deliverRetained(sub *subscription) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	for topic, event := range eventSystem.retained {
+		if Match(sub.Topic, topic) && sub.permits(event, subscribeGrant(topic)) && sub.accepts(event) {
+			select {
+			case sub.EventChan <- event:
+			default:
+				eventSystem.drop(sub.Topic)
+			}
 		}
-		delete(eventSystem.globs, id)
 	}
 }
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+Hierarchical topic matching. Topics are split into segments by "::".
+A "+" segment matches exactly one segment, a "#" segment matches any number
+of segments (including none), so "controller::#" matches "controller" and
+"controller::auth::login", while "controller::+::login" only matches the latter.
+*/
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	TOPIC_SEPARATOR   = "::"
+	SINGLE_LEVEL_WILD = "+"
+	MULTI_LEVEL_WILD  = "#"
+)
+
+func isWildcard(pattern string) bool {
+	for _, segment := range strings.Split(pattern, TOPIC_SEPARATOR) {
+		if segment == SINGLE_LEVEL_WILD || segment == MULTI_LEVEL_WILD {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Match reports whether topic matches pattern. The pattern can be a plain topic,
+a hierarchical wildcard pattern or a filepath.Match glob.
+*/
+func Match(pattern, topic string) bool {
+	switch {
+	case isWildcard(pattern):
+		{
+			return matchSegments(strings.Split(pattern, TOPIC_SEPARATOR), strings.Split(topic, TOPIC_SEPARATOR))
+		}
+	case isGlob(pattern):
+		{
+			ok, err := filepath.Match(pattern, topic)
+			return ok && err == nil
+		}
+	}
+	return pattern == topic
+}
+
+func matchSegments(pattern, topic []string) bool {
+	if len(pattern) == 0 {
+		return len(topic) == 0
+	}
+	switch pattern[0] {
+	case MULTI_LEVEL_WILD:
+		{
+			for i := 0; i <= len(topic); i++ {
+				if matchSegments(pattern[1:], topic[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+	case SINGLE_LEVEL_WILD:
+		{
+			return len(topic) > 0 && matchSegments(pattern[1:], topic[1:])
+		}
+	}
+	return len(topic) > 0 && pattern[0] == topic[0] && matchSegments(pattern[1:], topic[1:])
+}
+
+type trieNode struct {
+	children      map[string]*trieNode
+	subscriptions map[uint64]*subscription
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{
+		children:      make(map[string]*trieNode),
+		subscriptions: make(map[uint64]*subscription),
+	}
+}
+
+/*
+topicTrie holds the wildcard subscriptions, so that publish only walks the
+branches which can match a topic instead of testing every pattern.
+*/
+type topicTrie struct {
+	root *trieNode
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{root: newTrieNode()}
+}
+
+func (trie *topicTrie) insert(pattern string, id uint64, sub *subscription) {
+	node := trie.root
+	for _, segment := range strings.Split(pattern, TOPIC_SEPARATOR) {
+		next, ok := node.children[segment]
+		if !ok {
+			next = newTrieNode()
+			node.children[segment] = next
+		}
+		node = next
+	}
+	node.subscriptions[id] = sub
+}
+
+func (trie *topicTrie) remove(pattern string, id uint64) *subscription {
+	segments := strings.Split(pattern, TOPIC_SEPARATOR)
+	path := make([]*trieNode, 0, len(segments)+1)
+	node := trie.root
+	path = append(path, node)
+	for _, segment := range segments {
+		next, ok := node.children[segment]
+		if !ok {
+			return nil
+		}
+		node = next
+		path = append(path, node)
+	}
+	sub, ok := node.subscriptions[id]
+	if !ok {
+		return nil
+	}
+	delete(node.subscriptions, id)
+	//prune empty branches
+	for i := len(segments); i > 0; i-- {
+		if len(path[i].subscriptions) > 0 || len(path[i].children) > 0 {
+			break
+		}
+		delete(path[i-1].children, segments[i-1])
+	}
+	return sub
+}
+
+func (trie *topicTrie) match(topic string) map[uint64]*subscription {
+	result := make(map[uint64]*subscription)
+	trie.root.collect(strings.Split(topic, TOPIC_SEPARATOR), result)
+	return result
+}
+
+func (node *trieNode) collect(topic []string, result map[uint64]*subscription) {
+	if hash, ok := node.children[MULTI_LEVEL_WILD]; ok {
+		for i := 0; i <= len(topic); i++ {
+			hash.collect(topic[i:], result)
+		}
+	}
+	if len(topic) == 0 {
+		for id, sub := range node.subscriptions {
+			result[id] = sub
+		}
+		return
+	}
+	if plus, ok := node.children[SINGLE_LEVEL_WILD]; ok {
+		plus.collect(topic[1:], result)
+	}
+	if next, ok := node.children[topic[0]]; ok {
+		next.collect(topic[1:], result)
+	}
+}
+
+/*
+clone copies the nodes of the trie, so the copy can be modified while
+dispatchers still match against the original.
+*/
+func (trie *topicTrie) clone() *topicTrie {
+	return &topicTrie{root: trie.root.clone()}
+}
+
+func (node *trieNode) clone() *trieNode {
+	result := &trieNode{
+		children:      make(map[string]*trieNode, len(node.children)),
+		subscriptions: make(map[uint64]*subscription, len(node.subscriptions)),
+	}
+	for segment, child := range node.children {
+		result.children[segment] = child.clone()
+	}
+	for id, sub := range node.subscriptions {
+		result.subscriptions[id] = sub
+	}
+	return result
+}
+
+func (trie *topicTrie) all() map[uint64]*subscription {
+	result := make(map[uint64]*subscription)
+	trie.root.each(result)
+	return result
+}
+
+func (node *trieNode) each(result map[uint64]*subscription) {
+	for id, sub := range node.subscriptions {
+		result[id] = sub
+	}
+	for _, child := range node.children {
+		child.each(result)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"testing"
+)
+
+type matchSample struct {
+	Pattern string
+	Topic   string
+	Match   bool
+}
+
+var matchSamples = []matchSample{
+	{"controller::auth::login", "controller::auth::login", true},
+	{"controller::auth::login", "controller::auth::logout", false},
+	{"controller::#", "controller", true},
+	{"controller::#", "controller::auth::login", true},
+	{"controller::#", "controllers::auth", false},
+	{"controller::+::login", "controller::auth::login", true},
+	{"controller::+::login", "controller::auth::logout", false},
+	{"controller::+::login", "controller::login", false},
+	{"controller::+", "controller::auth::login", false},
+	{"+::auth::#", "controller::auth::login", true},
+	{"#", "anything::at::all", true},
+	{"hosts::*", "hosts::new", true},
+	{"*@foo", "test@foo", true},
+}
+
+func TestMatch(t *testing.T) {
+	for _, sample := range matchSamples {
+		if res := Match(sample.Pattern, sample.Topic); res != sample.Match {
+			t.Errorf("Match(%v, %v): wanted %v got %v", sample.Pattern, sample.Topic, sample.Match, res)
+		}
+	}
+}
+
+func TestTopicTrie(t *testing.T) {
+	trie := newTopicTrie()
+	for id, sample := range matchSamples {
+		if isWildcard(sample.Pattern) {
+			trie.insert(sample.Pattern, uint64(id), &subscription{Topic: sample.Pattern})
+		}
+	}
+	for id, sample := range matchSamples {
+		if !isWildcard(sample.Pattern) {
+			continue
+		}
+		_, found := trie.match(sample.Topic)[uint64(id)]
+		if found != sample.Match {
+			t.Errorf("trie match of %v against %v: wanted %v got %v", sample.Pattern, sample.Topic, sample.Match, found)
+		}
+	}
+	for id, sample := range matchSamples {
+		if isWildcard(sample.Pattern) {
+			if trie.remove(sample.Pattern, uint64(id)) == nil {
+				t.Errorf("failed removing %v from trie", sample.Pattern)
+			}
+		}
+	}
+	if len(trie.root.children) != 0 {
+		t.Errorf("trie not pruned after removing all patterns: %v", trie.root.children)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+/*
+Every event carries the id of the trace it belongs to and the id of the
+event which caused it. A published event without a trace starts a new one
+with its own id, awnsers and events created by NewChildEvent continue the
+trace of their parent. In JSON both ids are strings, because they do not fit
+into the numbers of javascript clients.
+*/
+
+import (
+	"context"
+)
+
+/*
+NewChildEvent creates an event caused by parent.
+*/
+func NewChildEvent(parent *Event, topic string, payload interface{}) *Event {
+	event := NewEvent(topic, payload)
+	if parent != nil {
+		event.TraceId = parent.TraceId
+		if event.TraceId == 0 {
+			event.TraceId = parent.Id
+		}
+		event.ParentId = parent.Id
+	}
+	return event
+}
+
+type contextKey int
+
+const parentEventKey contextKey = 0
+
+/*
+ContextWithEvent returns a context which makes requests sent with
+RequestContext children of event.
+*/
+func ContextWithEvent(ctx context.Context, event *Event) context.Context {
+	return context.WithValue(ctx, parentEventKey, event)
+}
+
+func EventFromContext(ctx context.Context) *Event {
+	event, _ := ctx.Value(parentEventKey).(*Event)
+	return event
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestTracePropagation(t *testing.T) {
+	requests, closeRequests := Subscribe("trace::request", 0)
+	defer func() { closeRequests <- true }()
+	awnsers, closeAwnsers := Subscribe("trace::awnser", 0)
+	defer func() { closeAwnsers <- true }()
+
+	root := NewEvent("trace::request", nil)
+	root.ReturnAddr = "trace::awnser"
+	Publish(root)
+	request := <-requests
+	if request.TraceId != root.Id {
+		t.Fatalf("expected root event to start a trace, got %v", request.TraceId)
+	}
+	Awnser(request, "ok")
+	awnser := <-awnsers
+	if awnser.TraceId != root.Id || awnser.ParentId != root.Id {
+		t.Errorf("awnser did not continue the trace: %+v", awnser)
+	}
+
+	go func() {
+		nested := <-requests
+		Awnser(nested, nested.ParentId)
+	}()
+	parent, err := RequestContext(ContextWithEvent(context.Background(), awnser), "trace::request", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.(uint64) != awnser.Id {
+		t.Errorf("expected request to be a child of %v, got %v", awnser.Id, parent)
+	}
+
+	marshaled, _ := json.Marshal(awnser)
+	decoded := new(Event)
+	if err := json.Unmarshal(marshaled, decoded); err != nil || decoded.TraceId != awnser.TraceId {
+		t.Errorf("trace id did not survive json (%s): %v", marshaled, err)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package jsengine
+
+/*
+JS interceptors run inside the dispatch goroutine of the engine, because the
+otto vm must not be used concurrently. Only publishers of events matching the
+pattern of an interceptor wait for its verdict, and at most
+jsengine.intercepttimeout milliseconds, then the event is rejected. The
+dispatch goroutine itself must never wait for the event system: events
+published from js go through the outbox, which publishes them in order from
+its own goroutine.
+*/
+
+import (
+	"errors"
+	"flag"
+	"github.com/robertkrimen/otto"
+	"github.com/trusch/susi/events"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var interceptTimeout = flag.String("jsengine.intercepttimeout", "100", "how many milliseconds publishers wait for a js interceptor before their event is rejected")
+
+func parseInterceptTimeout(value string) time.Duration {
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || millis <= 0 {
+		log.Print("invalid jsengine.intercepttimeout, using 100 milliseconds")
+		millis = 100
+	}
+	return time.Duration(millis) * time.Millisecond
+}
+
+type interceptRequest struct {
+	Function otto.Value
+	Event    *events.Event
+	Result   chan error
+}
+
+type outbox struct {
+	lock   sync.Mutex
+	events []*events.Event
+	signal chan bool
+}
+
+func newOutbox() *outbox {
+	box := &outbox{
+		signal: make(chan bool, 1),
+	}
+	go box.backend()
+	return box
+}
+
+func (box *outbox) push(event *events.Event) {
+	box.lock.Lock()
+	box.events = append(box.events, event)
+	box.lock.Unlock()
+	select {
+	case box.signal <- true:
+	default:
+	}
+}
+
+func (box *outbox) backend() {
+	for _ = range box.signal {
+		box.lock.Lock()
+		batch := box.events
+		box.events = nil
+		box.lock.Unlock()
+		for _, event := range batch {
+			events.Publish(event)
+		}
+	}
+}
+
+func (ptr *OttoEngine) registerInterceptor(name, pattern string, function otto.Value) {
+	events.RegisterTopicInterceptor("js:"+name, pattern, func(event *events.Event) error {
+		//js works on a copy, so a verdict which comes too late can not change the event
+		copied := *event
+		req := &interceptRequest{
+			Function: function,
+			Event:    &copied,
+			Result:   make(chan error, 1),
+		}
+		timeout := time.NewTimer(ptr.interceptTimeout)
+		defer timeout.Stop()
+		select {
+		case ptr.intercepts <- req:
+		case <-timeout.C:
+			return errors.New("js engine is busy")
+		}
+		select {
+		case err := <-req.Result:
+			{
+				if err == nil {
+					*event = copied
+				}
+				return err
+			}
+		case <-timeout.C:
+			{
+				return errors.New("js interceptor timed out")
+			}
+		}
+	})
+}
+
+/*
+runInterceptor calls the js function with the event. Returning false or a
+string rejects the event, returning an object replaces topic, payload,
+authlevel and returnaddr of the event. Anything else lets the event pass.
+*/
+func (ptr *OttoEngine) runInterceptor(req *interceptRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Print("PANIC while executing js interceptor: ", r)
+			err = errors.New("js interceptor failed")
+		}
+	}()
+	ptr.current = req.Event
+	defer func() { ptr.current = nil }()
+	eventVal, err := ptr.vm.ToValue(eventToMap(req.Event))
+	if err != nil {
+		return err
+	}
+	result, err := ptr.vm.Call("Function.call.call", nil, req.Function, nil, eventVal)
+	if err != nil {
+		return err
+	}
+	switch {
+	case result.IsString():
+		{
+			return errors.New(result.String())
+		}
+	case result.IsBoolean():
+		{
+			if ok, _ := result.ToBoolean(); !ok {
+				return errors.New("rejected")
+			}
+		}
+	case result.IsObject():
+		{
+			exported, _ := result.Export()
+			if modified, ok := exported.(map[string]interface{}); ok {
+				applyEventMap(req.Event, modified)
+			}
+		}
+	}
+	return nil
+}
+
+func applyEventMap(event *events.Event, modified map[string]interface{}) {
+	if topic, ok := modified["topic"].(string); ok {
+		event.Topic = topic
+	}
+	if payload, ok := modified["payload"]; ok {
+		event.Payload = payload
+	}
+	if returnaddr, ok := modified["returnaddr"].(string); ok {
+		event.ReturnAddr = returnaddr
+	}
+	switch authlevel := modified["authlevel"].(type) {
+	case float64:
+		{
+			event.AuthLevel = uint8(authlevel)
+		}
+	case int64:
+		{
+			event.AuthLevel = uint8(authlevel)
+		}
+	}
+}
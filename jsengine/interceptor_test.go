@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package jsengine
+
+import (
+	"fmt"
+	"github.com/robertkrimen/otto"
+	"github.com/trusch/susi/events"
+	"testing"
+	"time"
+)
+
+func init() {
+	events.Go()
+}
+
+/*
+newInterceptEngine returns an engine which only runs interceptors. If serve is
+false, nobody runs them, like when the engine is stuck in a slow callback.
+*/
+func newInterceptEngine(serve bool) *OttoEngine {
+	ptr := &OttoEngine{
+		vm:               otto.New(),
+		intercepts:       make(chan *interceptRequest),
+		interceptTimeout: 50 * time.Millisecond,
+	}
+	if serve {
+		go func() {
+			for req := range ptr.intercepts {
+				req.Result <- ptr.runInterceptor(req)
+			}
+		}()
+	}
+	return ptr
+}
+
+func jsFunction(t *testing.T, ptr *OttoEngine, source string) otto.Value {
+	function, err := ptr.vm.Run(source)
+	if err != nil || !function.IsFunction() {
+		t.Fatalf("no js function: %v", err)
+	}
+	return function
+}
+
+func TestJSInterceptorRewrite(t *testing.T) {
+	ptr := newInterceptEngine(true)
+	ptr.registerInterceptor("rewrite", "jsintercept::original", jsFunction(t, ptr, `(function(event) {
+		event.topic = "jsintercept::rewritten";
+		event.payload = {"count": event.payload.count + 1};
+		return event;
+	})`))
+	defer events.UnregisterInterceptor("js:rewrite")
+	ch, closeChan := events.Subscribe("jsintercept::rewritten", 0)
+	defer func() { closeChan <- true }()
+
+	if err := events.TryPublish(events.NewEvent("jsintercept::original", map[string]interface{}{"count": 1})); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-ch:
+		{
+			payload, ok := event.Payload.(map[string]interface{})
+			if !ok || fmt.Sprint(payload["count"]) != "2" {
+				t.Errorf("expected the payload of the interceptor, got %v", event.Payload)
+			}
+		}
+	case <-time.After(time.Second):
+		{
+			t.Error("the rewritten event was not delivered")
+		}
+	}
+}
+
+func TestJSInterceptorRejection(t *testing.T) {
+	ptr := newInterceptEngine(true)
+	ptr.registerInterceptor("reject", "jsintercept::guarded", jsFunction(t, ptr, `(function(event) {
+		return "not allowed";
+	})`))
+	defer events.UnregisterInterceptor("js:reject")
+	awnsers, closeAwnsers := events.Subscribe("jsintercept::awnser", 0)
+	defer func() { closeAwnsers <- true }()
+
+	event := events.NewEvent("jsintercept::guarded", nil)
+	event.ReturnAddr = "jsintercept::awnser"
+	if _, ok := events.TryPublish(event).(*events.RejectedError); !ok {
+		t.Error("expected the event to be rejected")
+	}
+	select {
+	case awnser := <-awnsers:
+		{
+			data, _ := awnser.Payload.(map[string]interface{})
+			if data["error"] != true || data["data"] != "event rejected by js:reject: not allowed" {
+				t.Errorf("unexpected awnser: %v", awnser.Payload)
+			}
+		}
+	case <-time.After(time.Second):
+		{
+			t.Error("the rejection was not sent to the returnaddr")
+		}
+	}
+}
+
+func TestJSInterceptorTimeout(t *testing.T) {
+	ptr := newInterceptEngine(false)
+	ptr.registerInterceptor("stuck", "jsintercept::stuck", jsFunction(t, ptr, `(function(event) {
+		return true;
+	})`))
+	defer events.UnregisterInterceptor("js:stuck")
+	ch, closeChan := events.Subscribe("jsintercept::other", 0)
+	defer func() { closeChan <- true }()
+
+	start := time.Now()
+	if err := events.TryPublish(events.NewEvent("jsintercept::other", nil)); err != nil {
+		t.Error(err)
+	}
+	if time.Since(start) >= ptr.interceptTimeout || len(ch) != 1 {
+		t.Error("events not matching the pattern must not wait for the js engine")
+	}
+	if _, ok := events.TryPublish(events.NewEvent("jsintercept::stuck", nil)).(*events.RejectedError); !ok {
+		t.Error("expected the event to be rejected once the timeout passed")
+	}
+}
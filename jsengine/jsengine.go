@@ -14,73 +14,123 @@ package jsengine
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/robertkrimen/otto"
 	_ "github.com/robertkrimen/otto/underscore"
 	"github.com/trusch/susi/events"
+	"github.com/trusch/susi/scheduler"
 	"github.com/trusch/susi/state"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var jsRoot = flag.String("jsengine.root", "/usr/share/susi/controller/js/", "where to search for backend js controllers")
+var jsAuthLevel = flag.String("jsengine.authlevel", "3", "authlevel of the events js controllers schedule without giving one")
 
-func isGlob(pattern string) bool {
-	return strings.IndexAny(pattern, "*?[") >= 0
+func parseAuthLevel(value string) uint8 {
+	authlevel, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		log.Print("invalid jsengine.authlevel, using 3")
+		authlevel = 3
+	}
+	return uint8(authlevel)
 }
 
 type subscription struct {
 	Functions map[int64]*otto.FunctionCall
 }
 
+/*
+Group and filtered subscriptions have their own bus subscription, because the
+event system decides which member of a group gets an event and which events
+pass a filter.
+*/
+type dedicatedSubscription struct {
+	Function  *otto.FunctionCall
+	CloseChan chan bool
+}
+
+type dedicatedDelivery struct {
+	Id    int64
+	Event *events.Event
+}
+
 type OttoEngine struct {
-	vm            *otto.Otto
-	input         chan *events.Event
-	subscriptions map[string]*subscription
+	vm             *otto.Otto
+	input          chan *events.Event
+	subscriptions  map[string]*subscription
+	dedicated      map[int64]*dedicatedSubscription
+	dedicatedInput chan *dedicatedDelivery
+	ids            *events.IdGenerator
+	intercepts     chan *interceptRequest
+	//how long publishers wait for a js interceptor
+	interceptTimeout time.Duration
+	//authlevel of scheduled events which do not name one
+	authlevel uint8
+	outbox    *outbox
+	//the event whose callbacks are running, events published by them become its children
+	current *events.Event
+}
+
+func eventToMap(event *events.Event) map[string]interface{} {
+	marshaled, _ := json.Marshal(event)
+	unmarshaled := make(map[string]interface{})
+	json.Unmarshal(marshaled, &unmarshaled)
+	return unmarshaled
 }
 
 func (ptr *OttoEngine) dispatchEvent(event *events.Event) {
 	//log.Print("dispatch event: ", event)
 	for key, subscription := range ptr.subscriptions {
-		var match bool = false
-		if isGlob(key) {
-			ok, err := filepath.Match(key, event.Topic)
-			if err != nil {
-				log.Print(err)
-				return
-			}
-			match = ok
-		}
-		if !match {
-			match = (key == event.Topic)
-		}
-		if match {
+		if events.Match(key, event.Topic) {
 			//log.Print("match ", key, " ", event.Topic)
 			for _, functionCall := range subscription.Functions {
-				marshaled, _ := json.Marshal(event)
-				unmarshaled := make(map[string]interface{})
-				json.Unmarshal(marshaled, &unmarshaled)
-				eventVal, err := ptr.vm.ToValue(unmarshaled)
-				if err != nil {
-					log.Print(err)
-				} else {
-					func() {
-						defer func() {
-							if r := recover(); r != nil {
-								log.Print("PANIC while executing js callback: ", r)
-							}
-						}()
-						ptr.vm.Call("Function.call.call", nil, functionCall.Argument(1), nil, eventVal)
-					}()
-				}
+				ptr.call(functionCall, event)
 			}
 		}
 	}
 }
 
+func (ptr *OttoEngine) dispatchDedicatedEvent(delivery *dedicatedDelivery) {
+	if sub, ok := ptr.dedicated[delivery.Id]; ok {
+		ptr.call(sub.Function, delivery.Event)
+	}
+}
+
+func (ptr *OttoEngine) call(functionCall *otto.FunctionCall, event *events.Event) {
+	ptr.current = event
+	defer func() { ptr.current = nil }()
+	eventVal, err := ptr.vm.ToValue(eventToMap(event))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Print("PANIC while executing js callback: ", r)
+			ptr.deadLetter(event, fmt.Sprint(r))
+		}
+	}()
+	if _, err := ptr.vm.Call("Function.call.call", nil, functionCall.Argument(1), nil, eventVal); err != nil {
+		log.Print("JS Error: ", err)
+		ptr.deadLetter(event, err.Error())
+	}
+}
+
+/*
+Dead letters go through the outbox, because the dispatch goroutine must not wait for the event system.
+*/
+func (ptr *OttoEngine) deadLetter(event *events.Event, detail string) {
+	if letter := events.NewDeadLetter(event, events.DEADLETTER_PANIC, detail); letter != nil {
+		ptr.outbox.push(letter)
+	}
+}
+
 func (ptr *OttoEngine) subscribe(topic string, function *otto.FunctionCall, authlevel uint8) int64 {
 	sub, ok := ptr.subscriptions[topic]
 	if !ok {
@@ -88,11 +138,27 @@ func (ptr *OttoEngine) subscribe(topic string, function *otto.FunctionCall, auth
 		sub.Functions = make(map[int64]*otto.FunctionCall)
 		ptr.subscriptions[topic] = sub
 	}
-	id := time.Now().UnixNano()
+	//ids start at zero, so they survive the round trip through js numbers
+	id := int64(ptr.ids.Next())
 	sub.Functions[id] = function
 	return id
 }
 
+func (ptr *OttoEngine) subscribeDedicated(topic string, function *otto.FunctionCall, authlevel uint8, options events.SubscribeOptions) int64 {
+	id := int64(ptr.ids.Next())
+	eventChan, closeChan := events.SubscribeWithOptions(topic, authlevel, options)
+	ptr.dedicated[id] = &dedicatedSubscription{
+		Function:  function,
+		CloseChan: closeChan,
+	}
+	go func() {
+		for event := range eventChan {
+			ptr.dedicatedInput <- &dedicatedDelivery{id, event}
+		}
+	}()
+	return id
+}
+
 func (ptr *OttoEngine) loadJS(filename string) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -133,6 +199,13 @@ func Go() {
 	ptr.vm = otto.New()
 	ptr.input = make(chan *events.Event, 10)
 	ptr.subscriptions = make(map[string]*subscription)
+	ptr.dedicated = make(map[int64]*dedicatedSubscription)
+	ptr.dedicatedInput = make(chan *dedicatedDelivery, 10)
+	ptr.ids = events.NewIdGenerator(0)
+	ptr.intercepts = make(chan *interceptRequest)
+	ptr.interceptTimeout = parseInterceptTimeout(state.Get("jsengine.intercepttimeout").(string))
+	ptr.authlevel = parseAuthLevel(state.Get("jsengine.authlevel").(string))
+	ptr.outbox = newOutbox()
 
 	dataChan, _ := events.Subscribe("*", 0)
 	go func() {
@@ -142,8 +215,21 @@ func Go() {
 	}()
 
 	go func() {
-		for event := range ptr.input {
-			ptr.dispatchEvent(event)
+		for {
+			select {
+			case event := <-ptr.input:
+				{
+					ptr.dispatchEvent(event)
+				}
+			case delivery := <-ptr.dedicatedInput:
+				{
+					ptr.dispatchDedicatedEvent(delivery)
+				}
+			case req := <-ptr.intercepts:
+				{
+					req.Result <- ptr.runInterceptor(req)
+				}
+			}
 		}
 	}()
 
@@ -174,18 +260,42 @@ func Go() {
 			returnaddr = ""
 		}
 
-		event := events.NewEvent(key, data)
+		event := events.NewChildEvent(ptr.current, key, data)
 		event.AuthLevel = uint8(authlevel)
 		event.ReturnAddr = returnaddr
+		events.MarkResponder(event, "jsengine")
+
+		ptr.outbox.push(event)
+
+		return otto.TrueValue()
+	})
 
-		events.Publish(event)
+	//susi.events.intercept(name, pattern, callback), only events matching pattern are passed to callback
+	eventsObj.Set("intercept", func(call otto.FunctionCall) otto.Value {
+		nameVal := call.Argument(0)
+		patternVal := call.Argument(1)
+		functionVal := call.Argument(2)
+		if !nameVal.IsString() || !patternVal.IsString() || patternVal.String() == "" || !functionVal.IsFunction() {
+			return otto.FalseValue()
+		}
+		ptr.registerInterceptor(nameVal.String(), patternVal.String(), functionVal)
+		return otto.TrueValue()
+	})
 
+	eventsObj.Set("unintercept", func(call otto.FunctionCall) otto.Value {
+		nameVal := call.Argument(0)
+		if !nameVal.IsString() {
+			return otto.FalseValue()
+		}
+		events.UnregisterInterceptor("js:" + nameVal.String())
 		return otto.TrueValue()
 	})
 
+	//susi.events.subscribe(topic, callback, authlevel, {group: "workers", balance: "least-loaded", filter: {"temp": {"$gt": 20}}})
 	eventsObj.Set("subscribe", func(call otto.FunctionCall) otto.Value {
 		keyVal := call.Argument(0)
 		authlevelVal := call.Argument(2)
+		optionsVal := call.Argument(3)
 		authlevel, err := authlevelVal.ToInteger()
 		key, err1 := keyVal.ToString()
 
@@ -193,7 +303,29 @@ func Go() {
 			return otto.FalseValue()
 		}
 
-		id := ptr.subscribe(key, &call, uint8(authlevel))
+		var id int64
+		if optionsVal.IsObject() {
+			exported, _ := optionsVal.Export()
+			options := events.SubscribeOptions{}
+			if data, ok := exported.(map[string]interface{}); ok {
+				options.Group, _ = data["group"].(string)
+				if name, ok := data["balance"].(string); ok {
+					if options.Balance, err = events.ParseBalancePolicy(name); err != nil {
+						log.Print("JS Error: ", err)
+						return otto.FalseValue()
+					}
+				}
+				if spec, ok := data["filter"].(map[string]interface{}); ok {
+					if options.Filter, err = events.ParseFilter(spec); err != nil {
+						log.Print("JS Error: ", err)
+						return otto.FalseValue()
+					}
+				}
+			}
+			id = ptr.subscribeDedicated(key, &call, uint8(authlevel), options)
+		} else {
+			id = ptr.subscribe(key, &call, uint8(authlevel))
+		}
 
 		idVal, _ := otto.ToValue(id)
 		return idVal
@@ -209,7 +341,16 @@ func Go() {
 			return otto.FalseValue()
 		}
 
-		subscription := ptr.subscriptions[key]
+		if sub, ok := ptr.dedicated[id]; ok {
+			sub.CloseChan <- true
+			delete(ptr.dedicated, id)
+			return otto.TrueValue()
+		}
+
+		subscription, ok := ptr.subscriptions[key]
+		if !ok {
+			return otto.FalseValue()
+		}
 		delete(subscription.Functions, id)
 		if len(subscription.Functions) == 0 {
 			delete(ptr.subscriptions, key)
@@ -217,7 +358,179 @@ func Go() {
 		return otto.TrueValue()
 	})
 
+	schedulerObj, _ := ptr.vm.Object(`({})`)
+
+	//susi.scheduler.at(topic, payload, unixSeconds), every(topic, payload, seconds) and cron(topic, payload, expr) return the schedule id
+	//an optional fourth argument sets the authlevel, it defaults to jsengine.authlevel
+	addSchedule := func(call otto.FunctionCall, add func(when otto.Value, event *events.Event) (uint64, error)) otto.Value {
+		keyVal := call.Argument(0)
+		dataVal := call.Argument(1)
+		if !keyVal.IsString() {
+			return otto.FalseValue()
+		}
+		data, err := dataVal.Export()
+		if err != nil {
+			return otto.FalseValue()
+		}
+		event := events.NewEvent(keyVal.String(), data)
+		if authlevelVal := call.Argument(3); authlevelVal.IsNumber() {
+			authlevel, _ := authlevelVal.ToInteger()
+			event.AuthLevel = uint8(authlevel)
+		} else {
+			event.AuthLevel = ptr.authlevel
+		}
+		id, err := add(call.Argument(2), event)
+		if err != nil {
+			log.Print("JS Error: ", err)
+			return otto.FalseValue()
+		}
+		idVal, _ := otto.ToValue(id)
+		return idVal
+	}
+
+	schedulerObj.Set("at", func(call otto.FunctionCall) otto.Value {
+		return addSchedule(call, func(when otto.Value, event *events.Event) (uint64, error) {
+			seconds, err := when.ToFloat()
+			if err != nil {
+				return 0, err
+			}
+			return scheduler.At(time.Unix(0, int64(seconds*float64(time.Second))), event)
+		})
+	})
+
+	schedulerObj.Set("every", func(call otto.FunctionCall) otto.Value {
+		return addSchedule(call, func(when otto.Value, event *events.Event) (uint64, error) {
+			seconds, err := when.ToFloat()
+			if err != nil {
+				return 0, err
+			}
+			return scheduler.Every(time.Duration(seconds*float64(time.Second)), event)
+		})
+	})
+
+	schedulerObj.Set("cron", func(call otto.FunctionCall) otto.Value {
+		return addSchedule(call, func(when otto.Value, event *events.Event) (uint64, error) {
+			return scheduler.Cron(when.String(), event)
+		})
+	})
+
+	schedulerObj.Set("cancel", func(call otto.FunctionCall) otto.Value {
+		id, err := call.Argument(0).ToInteger()
+		if err != nil {
+			return otto.FalseValue()
+		}
+		if scheduler.Cancel(uint64(id)) {
+			return otto.TrueValue()
+		}
+		return otto.FalseValue()
+	})
+
+	stateObj, _ := ptr.vm.Object(`({})`)
+
+	stateObj.Set("get", func(call otto.FunctionCall) otto.Value {
+		keyVal := call.Argument(0)
+		if !keyVal.IsString() {
+			return otto.UndefinedValue()
+		}
+		result, err := ptr.vm.ToValue(state.Get(keyVal.String()))
+		if err != nil {
+			log.Print("JS Error: ", err)
+			return otto.UndefinedValue()
+		}
+		return result
+	})
+
+	stateObj.Set("set", func(call otto.FunctionCall) otto.Value {
+		keyVal := call.Argument(0)
+		data, err := call.Argument(1).Export()
+		if !keyVal.IsString() || err != nil {
+			return otto.FalseValue()
+		}
+		state.Set(keyVal.String(), data)
+		return otto.TrueValue()
+	})
+
+	atomicResult := func(value interface{}, success bool, err error) otto.Value {
+		if err != nil {
+			log.Print("JS Error: ", err)
+			return otto.FalseValue()
+		}
+		result, err := ptr.vm.ToValue(map[string]interface{}{
+			"value":   value,
+			"success": success,
+		})
+		if err != nil {
+			log.Print("JS Error: ", err)
+			return otto.FalseValue()
+		}
+		return result
+	}
+
+	//susi.state.compareAndSet(key, expected, value) and susi.state.setIfAbsent(key, value) return {value: ..., success: ...} or false if the write failed
+	stateObj.Set("compareAndSet", func(call otto.FunctionCall) otto.Value {
+		keyVal := call.Argument(0)
+		expected, err1 := call.Argument(1).Export()
+		data, err2 := call.Argument(2).Export()
+		if !keyVal.IsString() || err1 != nil || err2 != nil {
+			return otto.FalseValue()
+		}
+		return atomicResult(state.CompareAndSet(keyVal.String(), expected, data))
+	})
+
+	stateObj.Set("setIfAbsent", func(call otto.FunctionCall) otto.Value {
+		keyVal := call.Argument(0)
+		data, err := call.Argument(1).Export()
+		if !keyVal.IsString() || err != nil {
+			return otto.FalseValue()
+		}
+		return atomicResult(state.SetIfAbsent(keyVal.String(), data))
+	})
+
+	//susi.state.increment(key, delta) returns the new number, delta defaults to 1
+	stateObj.Set("increment", func(call otto.FunctionCall) otto.Value {
+		keyVal := call.Argument(0)
+		if !keyVal.IsString() {
+			return otto.FalseValue()
+		}
+		delta := float64(1)
+		if deltaVal := call.Argument(1); deltaVal.IsNumber() {
+			delta, _ = deltaVal.ToFloat()
+		}
+		number, err := state.Increment(keyVal.String(), delta)
+		if err != nil {
+			log.Print("JS Error: ", err)
+			return otto.FalseValue()
+		}
+		result, _ := otto.ToValue(number)
+		return result
+	})
+
+	//susi.state.transaction([{type: "cas", key: "devices.lamp", expected: "off", value: "on"}]) returns the results or false if it failed
+	stateObj.Set("transaction", func(call otto.FunctionCall) otto.Value {
+		data, err := call.Argument(0).Export()
+		if err != nil {
+			return otto.FalseValue()
+		}
+		ops, err := state.ParseOperations(data)
+		if err != nil {
+			log.Print("JS Error: ", err)
+			return otto.FalseValue()
+		}
+		values, err := state.Transaction(ops)
+		if err != nil {
+			return otto.FalseValue()
+		}
+		result, err := ptr.vm.ToValue(values)
+		if err != nil {
+			log.Print("JS Error: ", err)
+			return otto.FalseValue()
+		}
+		return result
+	})
+
 	susiObj.Set("events", eventsObj)
+	susiObj.Set("scheduler", schedulerObj)
+	susiObj.Set("state", stateObj)
 	susiObj.Set("log", func(call otto.FunctionCall) otto.Value {
 		log.Print(call.Argument(0).String())
 		return otto.UndefinedValue()
@@ -0,0 +1,264 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package permissions
+
+/*
+Permissions are written as <domain>:<action>:<resource>, for example
+	events:publish:firebird::query
+	events:subscribe:session::*
+	state:write:devices.*
+	state:read:*
+Every part is a glob, the single permission "*" grants everything. Roles are
+named sets of permissions and are assigned to users. A user without roles
+gets the roles its authlevel maps to, so the old authlevels keep working:
+authlevel 0 maps to ROLE_ROOT and every other authlevel to ROLE_USER, which
+may publish, subscribe and use the state like before. The config
+(permissions.cfg) can define roles and change the mapping:
+	{
+		"roles": {"operator": ["events:*:*", "state:read:*", "state:write:devices.*"], "user": ["events:*:*", "state:read:*"]},
+		"authlevels": {"0": ["root"], "1": ["operator"], "default": ["user"]}
+	}
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ROLE_ROOT = "root"
+	ROLE_USER = "user"
+)
+
+const (
+	EVENTS = "events"
+	STATE  = "state"
+)
+
+const (
+	PUBLISH   = "publish"
+	SUBSCRIBE = "subscribe"
+	READ      = "read"
+	WRITE     = "write"
+)
+
+type registry struct {
+	roles        map[string][]string
+	authlevels   map[uint8][]string
+	defaultRoles []string
+	version      uint64
+}
+
+var (
+	lock    sync.Mutex
+	current atomic.Value
+	//counts the changes of the registry, guarded by lock
+	changes uint64
+)
+
+func init() {
+	Reset()
+}
+
+/*
+Reset restores the builtin roles and the builtin authlevel mapping.
+*/
+func Reset() {
+	lock.Lock()
+	defer lock.Unlock()
+	current.Store(&registry{
+		roles: map[string][]string{
+			ROLE_ROOT: {"*"},
+			ROLE_USER: {"events:*:*", "state:*:*"},
+		},
+		authlevels:   map[uint8][]string{0: {ROLE_ROOT}},
+		defaultRoles: []string{ROLE_USER},
+		version:      nextVersion(),
+	})
+}
+
+func nextVersion() uint64 {
+	changes++
+	return changes
+}
+
+/*
+Version changes whenever roles or mappings change, so callers can cache the
+results of Check until then.
+*/
+func Version() uint64 {
+	return current.Load().(*registry).version
+}
+
+func (reg *registry) clone() *registry {
+	copied := &registry{
+		roles:        make(map[string][]string, len(reg.roles)),
+		authlevels:   make(map[uint8][]string, len(reg.authlevels)),
+		defaultRoles: reg.defaultRoles,
+	}
+	for name, perms := range reg.roles {
+		copied.roles[name] = perms
+	}
+	for level, roles := range reg.authlevels {
+		copied.authlevels[level] = roles
+	}
+	return copied
+}
+
+func update(fn func(reg *registry)) {
+	lock.Lock()
+	defer lock.Unlock()
+	reg := current.Load().(*registry).clone()
+	fn(reg)
+	reg.version = nextVersion()
+	current.Store(reg)
+}
+
+/*
+DefineRole creates or replaces a role.
+*/
+func DefineRole(name string, permissions ...string) {
+	update(func(reg *registry) {
+		reg.roles[name] = permissions
+	})
+}
+
+func RemoveRole(name string) {
+	update(func(reg *registry) {
+		delete(reg.roles, name)
+	})
+}
+
+/*
+MapAuthLevel sets the roles of users with authlevel and no roles of their own.
+*/
+func MapAuthLevel(authlevel uint8, roles ...string) {
+	update(func(reg *registry) {
+		reg.authlevels[authlevel] = roles
+	})
+}
+
+/*
+MapDefaultAuthLevel sets the roles of all authlevels without an own mapping.
+*/
+func MapDefaultAuthLevel(roles ...string) {
+	update(func(reg *registry) {
+		reg.defaultRoles = roles
+	})
+}
+
+/*
+Load applies the config representation shown above, usually
+state.Get("permissions"). Roles and mappings not mentioned stay as they are.
+*/
+func Load(config interface{}) error {
+	if config == nil {
+		return nil
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	parsed := struct {
+		Roles      map[string][]string `json:"roles"`
+		AuthLevels map[string][]string `json:"authlevels"`
+	}{}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	levels := make(map[uint8][]string)
+	for key, roles := range parsed.AuthLevels {
+		if key == "default" {
+			continue
+		}
+		level, err := strconv.ParseUint(key, 10, 8)
+		if err != nil {
+			return errors.New("no such authlevel: " + key)
+		}
+		levels[uint8(level)] = roles
+	}
+	update(func(reg *registry) {
+		for name, perms := range parsed.Roles {
+			reg.roles[name] = perms
+		}
+		for level, roles := range levels {
+			reg.authlevels[level] = roles
+		}
+		if roles, ok := parsed.AuthLevels["default"]; ok {
+			reg.defaultRoles = roles
+		}
+	})
+	return nil
+}
+
+/*
+RolesOf returns roles, or the roles authlevel maps to if roles is empty.
+*/
+func RolesOf(roles []string, authlevel uint8) []string {
+	if len(roles) > 0 {
+		return roles
+	}
+	return current.Load().(*registry).rolesOf(authlevel)
+}
+
+func (reg *registry) rolesOf(authlevel uint8) []string {
+	if roles, ok := reg.authlevels[authlevel]; ok {
+		return roles
+	}
+	return reg.defaultRoles
+}
+
+/*
+Check tells whether a user with roles (or with authlevel, if it has no roles)
+may do action on resource in domain.
+*/
+func Check(roles []string, authlevel uint8, domain, action, resource string) bool {
+	reg := current.Load().(*registry)
+	if len(roles) == 0 {
+		roles = reg.rolesOf(authlevel)
+	}
+	for _, role := range roles {
+		for _, permission := range reg.roles[role] {
+			if Match(permission, domain, action, resource) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Match tells whether permission grants action on resource in domain.
+*/
+func Match(permission, domain, action, resource string) bool {
+	if permission == "*" {
+		return true
+	}
+	parts := strings.SplitN(permission, ":", 3)
+	if len(parts) != 3 {
+		return false
+	}
+	return matchPart(parts[0], domain) && matchPart(parts[1], action) && matchPart(parts[2], resource)
+}
+
+func matchPart(pattern, value string) bool {
+	if pattern == "*" || pattern == value {
+		return true
+	}
+	ok, err := filepath.Match(pattern, value)
+	return ok && err == nil
+}
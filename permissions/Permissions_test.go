@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package permissions
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	samples := []struct {
+		permission, domain, action, resource string
+		expected                             bool
+	}{
+		{"*", STATE, WRITE, "anything", true},
+		{"state:write:devices.*", STATE, WRITE, "devices.lamp.power", true},
+		{"state:write:devices.*", STATE, WRITE, "users.admin", false},
+		{"state:write:devices.*", STATE, READ, "devices.lamp", false},
+		{"events:publish:firebird::query", EVENTS, PUBLISH, "firebird::query", true},
+		{"events:*:session::*", EVENTS, SUBSCRIBE, "session::deleted", true},
+		{"events:publish", EVENTS, PUBLISH, "foo", false},
+	}
+	for _, sample := range samples {
+		if Match(sample.permission, sample.domain, sample.action, sample.resource) != sample.expected {
+			t.Errorf("%v on %v:%v:%v should be %v", sample.permission, sample.domain, sample.action, sample.resource, sample.expected)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	defer Reset()
+	if !Check(nil, 0, STATE, WRITE, "x") || !Check(nil, 255, EVENTS, PUBLISH, "foo") {
+		t.Error("the builtin mapping must keep the old authlevels working")
+	}
+	err := Load(map[string]interface{}{
+		"roles": map[string]interface{}{
+			"operator": []interface{}{"events:*:*", "state:write:devices.*"},
+			ROLE_USER:  []interface{}{"events:subscribe:*"},
+		},
+		"authlevels": map[string]interface{}{
+			"1": []interface{}{"operator"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Check(nil, 1, STATE, WRITE, "devices.lamp") || Check(nil, 1, STATE, WRITE, "users") {
+		t.Error("authlevel 1 should be an operator")
+	}
+	if Check(nil, 3, EVENTS, PUBLISH, "foo") || !Check(nil, 3, EVENTS, SUBSCRIBE, "foo") {
+		t.Error("other authlevels should use the redefined user role")
+	}
+	if !Check([]string{"operator"}, 255, EVENTS, PUBLISH, "foo") {
+		t.Error("own roles win over the authlevel")
+	}
+	if Check([]string{"missing"}, 0, EVENTS, PUBLISH, "foo") {
+		t.Error("unknown roles grant nothing")
+	}
+	if err := Load(map[string]interface{}{"authlevels": map[string]interface{}{"x": []interface{}{}}}); err == nil {
+		t.Error("expected bad authlevels to fail")
+	}
+}
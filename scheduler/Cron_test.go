@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	start := time.Date(2014, time.March, 14, 10, 17, 30, 0, time.UTC)
+	samples := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2014, time.March, 14, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2014, time.March, 14, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17 * * *", time.Date(2014, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2014, time.March, 15, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2014, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 1,3", time.Date(2014, time.March, 17, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2014, time.March, 16, 12, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2014, time.March, 21, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, sample := range samples {
+		cron, err := ParseCron(sample.expr)
+		if err != nil {
+			t.Errorf("%v: %v", sample.expr, err)
+			continue
+		}
+		if next := cron.Next(start); !next.Equal(sample.expected) {
+			t.Errorf("%v: expected %v, got %v", sample.expr, sample.expected, next)
+		}
+	}
+}
+
+func TestCronParseErrors(t *testing.T) {
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("expected %v to be rejected", expr)
+		}
+	}
+}
@@ -0,0 +1,628 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package scheduler
+
+/*
+The scheduler publishes events later: once at a given time, in a fixed
+interval or whenever a cron expression matches. Schedules are kept in the
+state under scheduler.schedules, which is always persisted, so they survive
+restarts whenever the state does (see state.persistence.dir).
+Interval schedules keep their phase: they fire at "at" plus a multiple of the
+interval, also after a restart. Intervals below scheduler.interval.min are
+rejected, and every user but authlevel 0 can have at most
+scheduler.maxperuser schedules.
+
+Besides the Go API, the scheduler answers these topics (apiserver clients
+publish them with a returnaddr):
+	scheduler::at     {"topic", "payload", "at": unix seconds | "in": seconds} -> id
+	scheduler::every  {"topic", "payload", "interval": seconds}                -> id
+	scheduler::cron   {"topic", "payload", "cron": "0 8 * * 1-5"}              -> id
+	scheduler::cancel id                                                       -> bool
+	scheduler::list                                                            -> schedules
+Scheduled events are published for the user and session of the request. The
+rights of a user are looked up whenever the schedule fires, so they follow
+changes to the user, and the schedules of deleted users are dropped. Schedules
+of anonymous or internal requests keep the authlevel and roles of the request.
+A schedule can only be listed or cancelled with at least its authlevel.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/trusch/susi/authentification"
+	"github.com/trusch/susi/events"
+	"github.com/trusch/susi/state"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var minInterval = flag.String("scheduler.interval.min", "1", "smallest interval of a schedule in seconds")
+var maxPerUser = flag.String("scheduler.maxperuser", "100", "how many schedules a user may have")
+
+func parseMinInterval() time.Duration {
+	seconds, err := strconv.ParseFloat(*minInterval, 64)
+	if err != nil || seconds <= 0 {
+		log.Print("invalid scheduler.interval.min, using 1 second")
+		seconds = 1
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func parseMaxPerUser() int {
+	max, err := strconv.Atoi(*maxPerUser)
+	if err != nil || max <= 0 {
+		log.Print("invalid scheduler.maxperuser, using 100")
+		max = 100
+	}
+	return max
+}
+
+const SCHEDULES_KEY = "scheduler.schedules"
+
+const ANONYMOUS = "anonymous"
+
+func init() {
+	state.AlwaysPersist(SCHEDULES_KEY)
+}
+
+/*
+lookupOwner returns the current rights of the user who owns a schedule.
+*/
+var lookupOwner = authentification.GetUser
+
+const (
+	SCHEDULE_AT    = "at"
+	SCHEDULE_EVERY = "every"
+	SCHEDULE_CRON  = "cron"
+)
+
+type Schedule struct {
+	Id        uint64        `json:"id"`
+	Type      string        `json:"type"`
+	At        time.Time     `json:"at"`
+	Interval  time.Duration `json:"interval,omitempty"`
+	Cron      string        `json:"cron,omitempty"`
+	Topic     string        `json:"topic"`
+	Payload   interface{}   `json:"payload,omitempty"`
+	AuthLevel uint8         `json:"authlevel"`
+	Username  string        `json:"username,omitempty"`
+	Roles     []string      `json:"roles,omitempty"`
+	SessionId uint64        `json:"sessionid,omitempty"`
+	next      time.Time
+	cron      *CronExpr
+}
+
+/*
+prepare computes the first time the schedule fires. One-shot schedules which
+were missed while the system was down fire immediately, interval schedules
+fire at their next slot after now. New interval schedules start now.
+*/
+func (schedule *Schedule) prepare(now time.Time, minInterval time.Duration) error {
+	switch schedule.Type {
+	case SCHEDULE_AT:
+		{
+			schedule.next = schedule.At
+		}
+	case SCHEDULE_EVERY:
+		{
+			if schedule.Interval < minInterval {
+				return errors.New("interval must be at least " + minInterval.String())
+			}
+			if schedule.At.IsZero() {
+				schedule.At = now
+			}
+			schedule.next = schedule.At.Add(schedule.Interval)
+			if !schedule.next.After(now) {
+				schedule.next = schedule.slotAfter(now)
+			}
+		}
+	case SCHEDULE_CRON:
+		{
+			cron, err := ParseCron(schedule.Cron)
+			if err != nil {
+				return err
+			}
+			schedule.cron = cron
+			schedule.next = cron.Next(now)
+			if schedule.next.IsZero() {
+				return errors.New("cron expression never matches: " + schedule.Cron)
+			}
+		}
+	default:
+		{
+			return errors.New("no such schedule type: " + schedule.Type)
+		}
+	}
+	return nil
+}
+
+/*
+slotAfter returns the first slot of an interval schedule after now, which
+must not be before At.
+*/
+func (schedule *Schedule) slotAfter(now time.Time) time.Time {
+	slots := now.Sub(schedule.At)/schedule.Interval + 1
+	return schedule.At.Add(slots * schedule.Interval)
+}
+
+/*
+advance moves the schedule past now and tells whether it fires again.
+*/
+func (schedule *Schedule) advance(now time.Time) bool {
+	switch schedule.Type {
+	case SCHEDULE_EVERY:
+		{
+			schedule.next = schedule.slotAfter(now)
+			return true
+		}
+	case SCHEDULE_CRON:
+		{
+			schedule.next = schedule.cron.Next(now)
+			return !schedule.next.IsZero()
+		}
+	}
+	return false
+}
+
+/*
+event builds the event of a fire. It carries the current rights of the owner,
+but never a lower authlevel than the schedule was created with. It returns nil
+if the owner no longer exists.
+*/
+func (schedule *Schedule) event() *events.Event {
+	event := events.NewEvent(schedule.Topic, schedule.Payload)
+	event.AuthLevel = schedule.AuthLevel
+	event.Username = schedule.Username
+	event.Roles = schedule.Roles
+	event.SessionId = schedule.SessionId
+	if schedule.Username == "" {
+		return event
+	}
+	owner := lookupOwner(schedule.Username)
+	if owner == nil {
+		if schedule.Username == ANONYMOUS {
+			return event
+		}
+		return nil
+	}
+	if owner.AuthLevel > event.AuthLevel {
+		event.AuthLevel = owner.AuthLevel
+	}
+	event.Roles = owner.Roles
+	return event
+}
+
+const (
+	ADDSCHEDULE int = iota
+	CANCELSCHEDULE
+	LISTSCHEDULES
+)
+
+type command struct {
+	Type      int
+	Schedule  *Schedule
+	Id        uint64
+	AuthLevel uint8
+	Return    chan interface{}
+}
+
+type Scheduler struct {
+	schedules   map[uint64]*Schedule
+	commands    chan *command
+	ids         *events.IdGenerator
+	key         string
+	minInterval time.Duration
+	maxPerUser  int
+}
+
+func (ptr *Scheduler) add(schedule *Schedule) (uint64, error) {
+	if err := schedule.prepare(time.Now(), ptr.minInterval); err != nil {
+		return 0, err
+	}
+	if schedule.AuthLevel > 0 && ptr.countOwnedBy(schedule.Username) >= ptr.maxPerUser {
+		return 0, errors.New("too many schedules for user " + schedule.Username)
+	}
+	schedule.Id = ptr.ids.Next()
+	ptr.schedules[schedule.Id] = schedule
+	ptr.persist()
+	return schedule.Id, nil
+}
+
+func (ptr *Scheduler) countOwnedBy(username string) (count int) {
+	for _, schedule := range ptr.schedules {
+		if schedule.Username == username {
+			count++
+		}
+	}
+	return count
+}
+
+func (ptr *Scheduler) cancel(id uint64, authlevel uint8) bool {
+	schedule, ok := ptr.schedules[id]
+	if !ok || authlevel > schedule.AuthLevel {
+		return false
+	}
+	delete(ptr.schedules, id)
+	ptr.persist()
+	return true
+}
+
+func (ptr *Scheduler) list() []Schedule {
+	list := make([]Schedule, 0, len(ptr.schedules))
+	for _, schedule := range ptr.schedules {
+		list = append(list, *schedule)
+	}
+	sort.Sort(byId(list))
+	return list
+}
+
+type byId []Schedule
+
+func (list byId) Len() int           { return len(list) }
+func (list byId) Less(i, j int) bool { return list[i].Id < list[j].Id }
+func (list byId) Swap(i, j int)      { list[i], list[j] = list[j], list[i] }
+
+/*
+persist writes all schedules to the state, as plain json values like the
+config and the restored state hold them.
+*/
+func (ptr *Scheduler) persist() {
+	if ptr.key == "" {
+		return
+	}
+	data, err := json.Marshal(ptr.list())
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	var schedules interface{}
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		log.Print(err)
+		return
+	}
+	state.Set(ptr.key, schedules)
+}
+
+func (ptr *Scheduler) fire(now time.Time) {
+	changed := false
+	for id, schedule := range ptr.schedules {
+		if schedule.next.After(now) {
+			continue
+		}
+		event := schedule.event()
+		if event == nil {
+			log.Printf("dropping schedule %v: user %v no longer exists", id, schedule.Username)
+			delete(ptr.schedules, id)
+			changed = true
+			continue
+		}
+		//published right here, so fires can not pile up in goroutines
+		events.Publish(event)
+		if !schedule.advance(now) {
+			delete(ptr.schedules, id)
+			changed = true
+		}
+	}
+	if changed {
+		ptr.persist()
+	}
+}
+
+func (ptr *Scheduler) nextFire() (next time.Time) {
+	for _, schedule := range ptr.schedules {
+		if next.IsZero() || schedule.next.Before(next) {
+			next = schedule.next
+		}
+	}
+	return next
+}
+
+func (ptr *Scheduler) backend() {
+	for {
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if next := ptr.nextFire(); !next.IsZero() {
+			timer = time.NewTimer(next.Sub(time.Now()))
+			timeout = timer.C
+		}
+		select {
+		case cmd := <-ptr.commands:
+			{
+				switch cmd.Type {
+				case ADDSCHEDULE:
+					{
+						id, err := ptr.add(cmd.Schedule)
+						if err != nil {
+							cmd.Return <- err
+						} else {
+							cmd.Return <- id
+						}
+					}
+				case CANCELSCHEDULE:
+					{
+						cmd.Return <- ptr.cancel(cmd.Id, cmd.AuthLevel)
+					}
+				case LISTSCHEDULES:
+					{
+						list := make([]Schedule, 0)
+						for _, schedule := range ptr.list() {
+							if cmd.AuthLevel <= schedule.AuthLevel {
+								list = append(list, schedule)
+							}
+						}
+						cmd.Return <- list
+					}
+				}
+			}
+		case <-timeout:
+			{
+				ptr.fire(time.Now())
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (ptr *Scheduler) Add(schedule *Schedule) (uint64, error) {
+	ret := make(chan interface{})
+	ptr.commands <- &command{
+		Type:     ADDSCHEDULE,
+		Schedule: schedule,
+		Return:   ret,
+	}
+	switch res := (<-ret).(type) {
+	case error:
+		return 0, res
+	default:
+		return res.(uint64), nil
+	}
+}
+
+func (ptr *Scheduler) Cancel(id uint64, authlevel uint8) bool {
+	ret := make(chan interface{})
+	ptr.commands <- &command{
+		Type:      CANCELSCHEDULE,
+		Id:        id,
+		AuthLevel: authlevel,
+		Return:    ret,
+	}
+	return (<-ret).(bool)
+}
+
+func (ptr *Scheduler) List(authlevel uint8) []Schedule {
+	ret := make(chan interface{})
+	ptr.commands <- &command{
+		Type:      LISTSCHEDULES,
+		AuthLevel: authlevel,
+		Return:    ret,
+	}
+	return (<-ret).([]Schedule)
+}
+
+/*
+NewScheduler restores the given schedules and starts the scheduler. Changes
+are saved to the state key unless it is empty.
+*/
+func NewScheduler(schedules []*Schedule, key string) *Scheduler {
+	scheduler := new(Scheduler)
+	scheduler.commands = make(chan *command, 10)
+	scheduler.schedules = make(map[uint64]*Schedule)
+	scheduler.key = key
+	scheduler.minInterval = parseMinInterval()
+	scheduler.maxPerUser = parseMaxPerUser()
+	var maxId uint64
+	now := time.Now()
+	for _, schedule := range schedules {
+		if err := schedule.prepare(now, scheduler.minInterval); err != nil {
+			log.Printf("dropping schedule %v: %v", schedule.Id, err)
+			continue
+		}
+		scheduler.schedules[schedule.Id] = schedule
+		if schedule.Id > maxId {
+			maxId = schedule.Id
+		}
+	}
+	//ids start small, so they survive the round trip through js numbers
+	scheduler.ids = events.NewIdGenerator(maxId)
+	go scheduler.backend()
+	return scheduler
+}
+
+var scheduler *Scheduler
+
+/*
+At publishes event once at the given time.
+*/
+func At(when time.Time, event *events.Event) (uint64, error) {
+	return scheduler.Add(newSchedule(SCHEDULE_AT, event, func(schedule *Schedule) {
+		schedule.At = when
+	}))
+}
+
+/*
+Every publishes event in a fixed interval, starting one interval from now.
+*/
+func Every(interval time.Duration, event *events.Event) (uint64, error) {
+	return scheduler.Add(newSchedule(SCHEDULE_EVERY, event, func(schedule *Schedule) {
+		schedule.Interval = interval
+	}))
+}
+
+/*
+Cron publishes event whenever the cron expression matches (see CronExpr).
+*/
+func Cron(expr string, event *events.Event) (uint64, error) {
+	return scheduler.Add(newSchedule(SCHEDULE_CRON, event, func(schedule *Schedule) {
+		schedule.Cron = expr
+	}))
+}
+
+func Cancel(id uint64) bool {
+	return scheduler.Cancel(id, 0)
+}
+
+func List() []Schedule {
+	return scheduler.List(0)
+}
+
+func newSchedule(scheduleType string, event *events.Event, fn func(schedule *Schedule)) *Schedule {
+	schedule := &Schedule{
+		Type:      scheduleType,
+		Topic:     event.Topic,
+		Payload:   event.Payload,
+		AuthLevel: event.AuthLevel,
+		Username:  event.Username,
+		Roles:     event.Roles,
+		SessionId: event.SessionId,
+	}
+	fn(schedule)
+	return schedule
+}
+
+func scheduleFromRequest(scheduleType string, event *events.Event) (*Schedule, error) {
+	data, ok := event.Payload.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("malformed schedule request")
+	}
+	topic, ok := data["topic"].(string)
+	if !ok || topic == "" {
+		return nil, errors.New("schedule request needs a topic")
+	}
+	scheduled := events.NewEvent(topic, data["payload"])
+	scheduled.AuthLevel = event.AuthLevel
+	scheduled.Username = event.Username
+	scheduled.Roles = event.Roles
+	scheduled.SessionId = event.SessionId
+	switch scheduleType {
+	case SCHEDULE_AT:
+		{
+			if at, ok := data["at"].(float64); ok {
+				return newSchedule(scheduleType, scheduled, func(schedule *Schedule) {
+					schedule.At = time.Unix(0, int64(at*float64(time.Second)))
+				}), nil
+			}
+			if in, ok := data["in"].(float64); ok {
+				return newSchedule(scheduleType, scheduled, func(schedule *Schedule) {
+					schedule.At = time.Now().Add(time.Duration(in * float64(time.Second)))
+				}), nil
+			}
+			return nil, errors.New("schedule request needs at or in")
+		}
+	case SCHEDULE_EVERY:
+		{
+			interval, ok := data["interval"].(float64)
+			if !ok {
+				return nil, errors.New("schedule request needs an interval")
+			}
+			return newSchedule(scheduleType, scheduled, func(schedule *Schedule) {
+				schedule.Interval = time.Duration(interval * float64(time.Second))
+			}), nil
+		}
+	}
+	expr, ok := data["cron"].(string)
+	if !ok {
+		return nil, errors.New("schedule request needs a cron expression")
+	}
+	return newSchedule(scheduleType, scheduled, func(schedule *Schedule) {
+		schedule.Cron = expr
+	}), nil
+}
+
+func scheduleIdFromRequest(payload interface{}) (uint64, bool) {
+	switch id := payload.(type) {
+	case float64:
+		return uint64(id), true
+	case uint64:
+		return id, true
+	case int64:
+		return uint64(id), true
+	case int:
+		return uint64(id), true
+	}
+	return 0, false
+}
+
+func loadSchedules(key string) []*Schedule {
+	saved := state.Get(key)
+	if saved == nil {
+		return nil
+	}
+	var schedules []*Schedule
+	if err := events.DecodeAs(saved, &schedules); err != nil {
+		log.Print("malformed schedules: ", err)
+		return nil
+	}
+	return schedules
+}
+
+func Go() {
+	scheduler = NewScheduler(loadSchedules(SCHEDULES_KEY), SCHEDULES_KEY)
+
+	atChan, _ := events.Subscribe("scheduler::at", 0)
+	everyChan, _ := events.Subscribe("scheduler::every", 0)
+	cronChan, _ := events.Subscribe("scheduler::cron", 0)
+	cancelChan, _ := events.Subscribe("scheduler::cancel", 0)
+	listChan, _ := events.Subscribe("scheduler::list", 0)
+
+	addFromRequest := func(scheduleType string, event *events.Event) {
+		schedule, err := scheduleFromRequest(scheduleType, event)
+		if err != nil {
+			events.AwnserError(event, err.Error())
+			return
+		}
+		id, err := scheduler.Add(schedule)
+		if err != nil {
+			events.AwnserError(event, err.Error())
+			return
+		}
+		events.Awnser(event, id)
+	}
+
+	go func() {
+		for {
+			select {
+			case event := <-atChan:
+				{
+					addFromRequest(SCHEDULE_AT, event)
+				}
+			case event := <-everyChan:
+				{
+					addFromRequest(SCHEDULE_EVERY, event)
+				}
+			case event := <-cronChan:
+				{
+					addFromRequest(SCHEDULE_CRON, event)
+				}
+			case event := <-cancelChan:
+				{
+					id, ok := scheduleIdFromRequest(event.Payload)
+					if !ok {
+						events.AwnserError(event, "malformed schedule id")
+						break
+					}
+					events.Awnser(event, scheduler.Cancel(id, event.AuthLevel))
+				}
+			case event := <-listChan:
+				{
+					events.Awnser(event, scheduler.List(event.AuthLevel))
+				}
+			}
+		}
+	}()
+
+	log.Print("Successfully started scheduler with ", len(List()), " schedules")
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package scheduler
+
+import (
+	"github.com/trusch/susi/authentification"
+	"github.com/trusch/susi/events"
+	"github.com/trusch/susi/state"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+	events.Go()
+	state.Go()
+	//the tests can not wait for seconds
+	*minInterval = "0.01"
+}
+
+func TestSchedulerFiresAndPersists(t *testing.T) {
+	key := "scheduler.test" + strconv.FormatUint(events.NextId(), 10)
+	scheduler = NewScheduler(nil, key)
+
+	ch, closeChan := events.Subscribe("scheduler::test", 0)
+	defer func() { closeChan <- true }()
+
+	if _, err := At(time.Now().Add(20*time.Millisecond), events.NewEvent("scheduler::test", "once")); err != nil {
+		t.Fatal(err)
+	}
+	every, err := Every(30*time.Millisecond, events.NewEvent("scheduler::test", "again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Cron("0 0 31 2 *", events.NewEvent("scheduler::test", nil)); err == nil {
+		t.Error("expected a cron expression which never matches to be rejected")
+	}
+	counts := make(map[string]int)
+	timeout := time.After(2 * time.Second)
+	for counts["once"] < 1 || counts["again"] < 2 {
+		select {
+		case event := <-ch:
+			counts[event.Payload.(string)]++
+		case <-timeout:
+			t.Fatalf("schedules did not fire: %v", counts)
+		}
+	}
+	if counts["once"] != 1 {
+		t.Errorf("one-shot schedule fired %v times", counts["once"])
+	}
+
+	saved := loadSchedules(key)
+	if len(saved) != 1 || saved[0].Id != every {
+		t.Fatalf("expected only the interval schedule to be saved, got %v", state.Get(key))
+	}
+
+	restored := NewScheduler(saved, "")
+	if list := restored.List(0); len(list) != 1 || list[0].Interval != 30*time.Millisecond {
+		t.Errorf("schedule was not restored: %v", list)
+	}
+	restored.Cancel(every, 0)
+	if !Cancel(every) || Cancel(every) {
+		t.Error("expected cancel to succeed exactly once")
+	}
+}
+
+func TestSchedulerRestoresOwnerAndPhase(t *testing.T) {
+	key := "scheduler.test" + strconv.FormatUint(events.NextId(), 10)
+	scheduler = NewScheduler(nil, key)
+	defer func(lookup func(string) *authentification.User) { lookupOwner = lookup }(lookupOwner)
+	owners := map[string]*authentification.User{
+		"alice": {Username: "alice", AuthLevel: 2, Roles: []string{"operator"}},
+	}
+	lookupOwner = func(name string) *authentification.User {
+		return owners[name]
+	}
+
+	event := events.NewEvent("scheduler::owned", nil)
+	event.AuthLevel = 2
+	event.Username = "alice"
+	event.Roles = []string{"operator"}
+	event.SessionId = 42
+	id, err := Every(time.Hour, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cancel(id)
+
+	schedules := loadSchedules(key)
+	if len(schedules) != 1 {
+		t.Fatalf("expected the schedule to be saved, got %v", schedules)
+	}
+	restored := schedules[0].event()
+	if restored.AuthLevel != 2 || restored.Username != "alice" || restored.SessionId != 42 || len(restored.Roles) != 1 || restored.Roles[0] != "operator" {
+		t.Errorf("the owner of the schedule was not restored: %v", restored)
+	}
+
+	//fires follow the current rights of the owner
+	owners["alice"] = &authentification.User{Username: "alice", AuthLevel: 3}
+	if fired := schedules[0].event(); fired.AuthLevel != 3 || len(fired.Roles) != 0 {
+		t.Errorf("expected the revoked rights to apply, got %v %v", fired.AuthLevel, fired.Roles)
+	}
+	delete(owners, "alice")
+	if fired := schedules[0].event(); fired != nil {
+		t.Errorf("expected no event for a deleted owner, got %v", fired)
+	}
+
+	//a restart keeps the slots of the interval
+	now := time.Now()
+	schedule := schedules[0]
+	schedule.At = now.Add(-150 * time.Minute)
+	if err := schedule.prepare(now, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if expected := now.Add(30 * time.Minute); !schedule.next.Equal(expected) {
+		t.Errorf("expected the next slot at %v, got %v", expected, schedule.next)
+	}
+}
+
+func TestSchedulerLimits(t *testing.T) {
+	defer func(interval, max string) { *minInterval, *maxPerUser = interval, max }(*minInterval, *maxPerUser)
+	*minInterval, *maxPerUser = "1", "2"
+	limited := NewScheduler(nil, "")
+
+	event := events.NewEvent("scheduler::limited", nil)
+	event.AuthLevel = 3
+	event.Username = "mallory"
+	every := newSchedule(SCHEDULE_EVERY, event, func(schedule *Schedule) {
+		schedule.Interval = time.Nanosecond
+	})
+	if _, err := limited.Add(every); err == nil {
+		t.Error("expected intervals below the minimum to be rejected")
+	}
+	for i := 0; i < 3; i++ {
+		_, err := limited.Add(newSchedule(SCHEDULE_AT, event, func(schedule *Schedule) {
+			schedule.At = time.Now().Add(time.Hour)
+		}))
+		if (i < 2) != (err == nil) {
+			t.Errorf("schedule %v of a user allowed 2: %v", i+1, err)
+		}
+	}
+	event.AuthLevel = 0
+	if _, err := limited.Add(newSchedule(SCHEDULE_AT, event, func(schedule *Schedule) {
+		schedule.At = time.Now().Add(time.Hour)
+	})); err != nil {
+		t.Error("authlevel 0 is not limited: ", err)
+	}
+}
@@ -12,6 +12,7 @@
 package session
 
 import (
+	"errors"
 	"flag"
 	"github.com/trusch/susi/events"
 	"github.com/trusch/susi/state"
@@ -37,6 +38,7 @@ const (
 	TOUCHSESSION
 	UPDATESESSION
 	GETSESSION
+	RECONFIGURE
 )
 
 type sessionCommand struct {
@@ -49,19 +51,73 @@ type sessionCommand struct {
 type SessionManager struct {
 	sessions []*Session
 	commands chan sessionCommand
+	lifetime int64
+	interval int64
+	ticker   *time.Ticker
 }
 
-func (ptr *SessionManager) addSession(data map[string]interface{}) (id uint64) {
-	id = uint64(time.Now().UnixNano())
-	lifetimeStr := state.Get("session.lifetime").(string)
-	lifetime, err := strconv.ParseInt(lifetimeStr, 10, 64)
-	if err != nil {
-		log.Fatal(err)
+/*
+seconds reads a setting which is a string from the flags or a number if it
+was changed at runtime.
+*/
+func seconds(key string) (int64, error) {
+	switch value := state.Get(key).(type) {
+	case string:
+		{
+			return strconv.ParseInt(value, 10, 64)
+		}
+	case float64:
+		{
+			return int64(value), nil
+		}
+	case int:
+		{
+			return int64(value), nil
+		}
+	case int64:
+		{
+			return value, nil
+		}
+	}
+	return 0, errors.New(key + " is not a number of seconds")
+}
+
+/*
+reconfigure re-reads the settings. Sessions keep the time they were granted
+beyond the old lifetime under the new one.
+*/
+func (ptr *SessionManager) reconfigure() {
+	lifetime, err := seconds("session.lifetime")
+	if err != nil || lifetime <= 0 {
+		log.Printf("invalid session.lifetime, keeping %v seconds", ptr.lifetime)
+		lifetime = ptr.lifetime
+	}
+	interval, err := seconds("session.checkinterval")
+	if err != nil || interval <= 0 {
+		log.Printf("invalid session.checkinterval, keeping %v seconds", ptr.interval)
+		interval = ptr.interval
+	}
+	if ptr.lifetime > 0 && lifetime != ptr.lifetime {
+		for _, session := range ptr.sessions {
+			session.ValidUntil += lifetime - ptr.lifetime
+		}
+	}
+	ptr.lifetime = lifetime
+	if interval != ptr.interval || ptr.ticker == nil {
+		if ptr.ticker != nil {
+			ptr.ticker.Stop()
+		}
+		ptr.ticker = time.NewTicker(time.Duration(interval) * time.Second)
+		ptr.interval = interval
 	}
+}
+
+func (ptr *SessionManager) addSession(data map[string]interface{}) (id uint64) {
+	id = events.NextId()
 	session := &Session{
 		Id:         id,
 		Data:       data,
-		ValidUntil: time.Now().Unix() + lifetime,
+		ValidUntil: time.Now().Unix() + ptr.lifetime,
 	}
 	ptr.sessions = append(ptr.sessions, session)
 	return id
@@ -81,14 +137,9 @@ func (ptr *SessionManager) delSession(id uint64) bool {
 }
 
 func (ptr *SessionManager) touchSession(id uint64) bool {
-	lifetimeStr := state.Get("session.lifetime").(string)
-	lifetime, err := strconv.ParseInt(lifetimeStr, 10, 64)
-	if err != nil {
-		log.Fatal(err)
-	}
 	for _, session := range ptr.sessions {
 		if session.Id == id {
-			session.ValidUntil = time.Now().Unix() + lifetime
+			session.ValidUntil = time.Now().Unix() + ptr.lifetime
 			return true
 		}
 	}
@@ -120,12 +171,6 @@ func (ptr *SessionManager) checkSessions() {
 }
 
 func (ptr *SessionManager) backend() {
-	intervalStr := state.Get("session.checkinterval").(string)
-	interval, err := strconv.ParseInt(intervalStr, 10, 64)
-	if err != nil {
-		log.Fatal(err)
-	}
-	ticker := time.Tick(time.Duration(interval) * time.Second)
 	for {
 		select {
 		case cmd := <-ptr.commands:
@@ -147,9 +192,13 @@ func (ptr *SessionManager) backend() {
 					{
 						cmd.Return <- ptr.getSession(cmd.Id)
 					}
+				case RECONFIGURE:
+					{
+						ptr.reconfigure()
+					}
 				}
 			}
-		case <-ticker:
+		case <-ptr.ticker.C:
 			{
 				ptr.checkSessions()
 			}
@@ -198,10 +247,21 @@ func (ptr *SessionManager) GetSession(id uint64) *Session {
 	return (<-ret).(*Session)
 }
 
+/*
+Reconfigure makes the manager re-read session.lifetime and session.checkinterval.
+*/
+func (ptr *SessionManager) Reconfigure() {
+	ptr.commands <- sessionCommand{Type: RECONFIGURE}
+}
+
 func NewSessionManager() *SessionManager {
 	manager := new(SessionManager)
 	manager.commands = make(chan sessionCommand, 10)
 	manager.sessions = make([]*Session, 0, 32)
+	manager.reconfigure()
+	if manager.lifetime <= 0 || manager.interval <= 0 {
+		log.Fatal("session.lifetime and session.checkinterval must be positive numbers of seconds")
+	}
 	go manager.backend()
 	return manager
 }
@@ -210,6 +270,12 @@ var sessionManager *SessionManager
 
 func Go() {
 
+	//session ids arrive as float64 from the network
+	sessionIdCodec := events.NewTypeCodec("session.id", uint64(0))
+	for _, topic := range []string{"session::del", "session::get", "session::touch", "session::deleted"} {
+		events.RegisterPayload(topic, sessionIdCodec)
+	}
+
 	addSessionChan, _ := events.Subscribe("session::add", 0)
 	delSessionChan, _ := events.Subscribe("session::del", 0)
 	getSessionChan, _ := events.Subscribe("session::get", 0)
@@ -217,6 +283,15 @@ func Go() {
 
 	sessionManager = NewSessionManager()
 
+	//follow changes of the settings at runtime
+	state.Watch("session.*")
+	settingsChan, _ := events.Subscribe(state.CHANGED_TOPIC_PREFIX+"session.*", 0)
+	go func() {
+		for range settingsChan {
+			sessionManager.Reconfigure()
+		}
+	}()
+
 	go func() {
 		for {
 			select {
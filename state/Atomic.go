@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package state
+
+/*
+Atomic operations read and write a key in one command, so clients do not
+race each other between a get and a set. They all return the value the key
+holds afterwards.
+*/
+
+import (
+	"errors"
+)
+
+type atomicResult struct {
+	Value interface{}
+	Ok    bool
+	Err   error
+}
+
+func atomicCommand(cmd *command) *atomicResult {
+	cmd.Return = make(chan interface{})
+	stateMachine.cmdChan <- cmd
+	return (<-cmd.Return).(*atomicResult)
+}
+
+/*
+CompareAndSet sets key to val if it holds expected (nil means unset). It
+returns the value of key afterwards and whether it was set. It fails if val
+can not be written to key, e.g. because a parent of key is no object.
+*/
+func CompareAndSet(key string, expected, val interface{}) (interface{}, bool, error) {
+	result := atomicCommand(&command{
+		Type:     COMPARE_AND_SET,
+		Key:      key,
+		Value:    val,
+		Expected: expected,
+	})
+	return result.Value, result.Ok, result.Err
+}
+
+/*
+Increment adds delta to the number at key, an unset key counts as 0.
+It fails if key holds something else than a number.
+*/
+func Increment(key string, delta float64) (float64, error) {
+	result := atomicCommand(&command{
+		Type:  INCREMENT,
+		Key:   key,
+		Value: delta,
+	})
+	if result.Err != nil {
+		return 0, result.Err
+	}
+	return result.Value.(float64), nil
+}
+
+/*
+SetIfAbsent sets key to val if it is unset. It returns the value of key
+afterwards and whether it was set, and fails like CompareAndSet.
+*/
+func SetIfAbsent(key string, val interface{}) (interface{}, bool, error) {
+	result := atomicCommand(&command{
+		Type:  SET_IF_ABSENT,
+		Key:   key,
+		Value: val,
+	})
+	return result.Value, result.Ok, result.Err
+}
+
+func (sm *StateMachine) compareAndSet(cmd *command) *atomicResult {
+	current, _ := sm.lookup(cmd.Key)
+	if !valuesEqual(current, cmd.Expected) {
+		return &atomicResult{Value: current}
+	}
+	if _, err := sm.write(cmd.Key, cmd.Value, nil); err != nil {
+		return &atomicResult{Value: current, Err: err}
+	}
+	sm.persist(cmd.Key, false)
+	sm.changed(cmd.Key, current, cmd.Value)
+	return &atomicResult{Value: cmd.Value, Ok: true}
+}
+
+func (sm *StateMachine) increment(cmd *command) *atomicResult {
+	current, exists := sm.lookup(cmd.Key)
+	number := float64(0)
+	if exists {
+		var ok bool
+		if number, ok = toNumber(current); !ok {
+			return &atomicResult{Value: current, Err: errors.New(cmd.Key + " is not a number")}
+		}
+	}
+	number += cmd.Value.(float64)
+	if _, err := sm.write(cmd.Key, number, nil); err != nil {
+		return &atomicResult{Value: current, Err: err}
+	}
+	sm.persist(cmd.Key, false)
+	sm.changed(cmd.Key, current, number)
+	return &atomicResult{Value: number, Ok: true}
+}
+
+func (sm *StateMachine) setIfAbsent(cmd *command) *atomicResult {
+	if current, exists := sm.lookup(cmd.Key); exists {
+		return &atomicResult{Value: current}
+	}
+	if _, err := sm.write(cmd.Key, cmd.Value, nil); err != nil {
+		return &atomicResult{Err: err}
+	}
+	sm.persist(cmd.Key, false)
+	sm.changed(cmd.Key, nil, cmd.Value)
+	return &atomicResult{Value: cmd.Value, Ok: true}
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case float32:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case uint64:
+		return float64(number), true
+	case uint8:
+		return float64(number), true
+	}
+	return 0, false
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package state
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/trusch/susi/events"
+)
+
+func TestCompareAndSet(t *testing.T) {
+	key := "cas.lamp" + strconv.FormatUint(events.NextId(), 10)
+	if value, ok, err := CompareAndSet(key, nil, "off"); !ok || err != nil || value != "off" {
+		t.Errorf("expected the unset key to be set, got %v", value)
+	}
+	if value, ok, err := CompareAndSet(key, "on", "off"); ok || err != nil || value != "off" {
+		t.Errorf("expected the swap to fail and return the current value, got %v", value)
+	}
+	if value, ok, err := CompareAndSet(key, "off", "on"); !ok || err != nil || value != "on" {
+		t.Errorf("expected the swap to succeed, got %v", value)
+	}
+	//the lamp holds a string, so nothing can be written below it
+	if _, ok, err := CompareAndSet(key+".brightness", nil, 100); ok || err == nil {
+		t.Error("expected the failed write to be reported")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	prefix := "counters" + strconv.FormatUint(events.NextId(), 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Increment(prefix+".visits", 1)
+		}()
+	}
+	wg.Wait()
+	if value, err := Increment(prefix+".visits", 0.5); err != nil || value != 50.5 {
+		t.Errorf("expected 50.5, got %v (%v)", value, err)
+	}
+	Set(prefix+".name", "foo")
+	if _, err := Increment(prefix+".name", 1); err == nil {
+		t.Error("expected strings not to be incremented")
+	}
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	key := "absent.owner" + strconv.FormatUint(events.NextId(), 10)
+	if value, ok, err := SetIfAbsent(key, "a"); !ok || err != nil || value != "a" {
+		t.Errorf("expected the key to be set, got %v", value)
+	}
+	if value, ok, err := SetIfAbsent(key, "b"); ok || err != nil || value != "a" {
+		t.Errorf("expected the first value to stay, got %v", value)
+	}
+	if _, ok, err := SetIfAbsent(key+".name", "c"); ok || err == nil {
+		t.Error("expected the failed write to be reported")
+	}
+}
@@ -0,0 +1,437 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package state
+
+/*
+The state can optionally survive restarts. Every write to a persisted key is
+appended to a write-ahead log, and the persisted part of the state is
+periodically written to a snapshot, which empties the log. Go restores the
+snapshot and replays the log before anything else can use the state.
+A key is persisted if it is (or lies below) one of the persisted prefixes and
+not below one of the ephemeral prefixes, e.g. with the prefixes "devices,jobs"
+and the ephemeral prefix "devices.cache". Without persisted prefixes nothing
+is persisted, keys have to be opted in, by the config or by AlwaysPersist. Log entries hold the whole value of a
+key after the write, so replaying an entry twice does no harm. The log is
+synced to disk every state.persistence.sync milliseconds (0 syncs every
+write), so a crash loses at most the writes of the last interval.
+The config and the flags are loaded into the state after it was restored, so
+they win over persisted values of the same keys.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var persistenceDir = flag.String("state.persistence.dir", "", "where to keep the state across restarts (empty disables persistence)")
+var persistencePrefixes = flag.String("state.persistence.prefixes", "", "comma separated key prefixes to persist (empty persists nothing)")
+var persistenceEphemeral = flag.String("state.persistence.ephemeral", "", "comma separated key prefixes which are never persisted")
+var persistenceInterval = flag.String("state.persistence.interval", "60", "seconds between two snapshots of the persisted state")
+var persistenceSync = flag.String("state.persistence.sync", "100", "milliseconds between two syncs of the state log (0 syncs every write)")
+
+/*
+keys other packages keep their own data in, persisted whatever the prefixes say
+*/
+var alwaysPersisted []string
+
+/*
+AlwaysPersist opts key into persistence, for packages which keep data in the
+state that has to survive restarts. It has to be called before Go, best from
+an init function.
+*/
+func AlwaysPersist(key string) {
+	alwaysPersisted = append(alwaysPersisted, key)
+}
+
+const (
+	SNAPSHOT_FILE = "state.snapshot"
+	WAL_FILE      = "state.wal"
+)
+
+type walEntry struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+	Unset bool        `json:"unset,omitempty"`
+	//push, pop and their friends use the key as top level key, dots included
+	Literal bool `json:"literal,omitempty"`
+}
+
+type persistence struct {
+	dir       string
+	persisted []string
+	ephemeral []string
+	wal       *os.File
+	encoder   *json.Encoder
+	//whether there were writes since the last snapshot
+	dirty bool
+	//0 syncs every write, otherwise the SYNC command syncs in this interval
+	syncInterval time.Duration
+	//whether there were writes since the last sync
+	unsynced bool
+}
+
+func parsePrefixes(prefixes string) []string {
+	result := make([]string, 0)
+	for _, prefix := range strings.Split(prefixes, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			result = append(result, prefix)
+		}
+	}
+	return result
+}
+
+func parseSnapshotInterval() time.Duration {
+	seconds, err := strconv.ParseInt(*persistenceInterval, 10, 64)
+	if err != nil || seconds <= 0 {
+		log.Print("invalid state.persistence.interval, using 60 seconds")
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func parseSyncInterval() time.Duration {
+	millis, err := strconv.ParseInt(*persistenceSync, 10, 64)
+	if err != nil || millis < 0 {
+		log.Print("invalid state.persistence.sync, syncing every write")
+		millis = 0
+	}
+	return time.Duration(millis) * time.Millisecond
+}
+
+/*
+underPrefix reports whether key is prefix or lies below it.
+*/
+func underPrefix(key, prefix string) bool {
+	return key == prefix || strings.HasPrefix(key, prefix+".")
+}
+
+/*
+belowKey reports whether prefix lies strictly below key, everything lies below the root "".
+*/
+func belowKey(prefix, key string) bool {
+	return key == "" || strings.HasPrefix(prefix, key+".")
+}
+
+func joinKey(key, child string) string {
+	if key == "" {
+		return child
+	}
+	return key + "." + child
+}
+
+func (p *persistence) ephemeralKey(key string) bool {
+	for _, prefix := range p.ephemeral {
+		if underPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *persistence) persists(key string) bool {
+	if p.ephemeralKey(key) {
+		return false
+	}
+	for _, prefix := range p.persisted {
+		if key != "" && underPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+pure reports whether the whole value of key is persisted.
+*/
+func (p *persistence) pure(key string) bool {
+	if !p.persists(key) {
+		return false
+	}
+	for _, prefix := range p.ephemeral {
+		if belowKey(prefix, key) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+relevant reports whether key or something below it is persisted.
+*/
+func (p *persistence) relevant(key string) bool {
+	if p.persists(key) {
+		return true
+	}
+	if p.ephemeralKey(key) {
+		return false
+	}
+	for _, prefix := range p.persisted {
+		if belowKey(prefix, key) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+strip returns the persisted part of the value of key and whether there is one.
+*/
+func (p *persistence) strip(key string, value interface{}) (interface{}, bool) {
+	if p.pure(key) {
+		return value, true
+	}
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return value, p.persists(key)
+	}
+	if !p.relevant(key) {
+		return nil, false
+	}
+	stripped := make(map[string]interface{}, len(obj))
+	for child, childValue := range obj {
+		if childValue, ok := p.strip(joinKey(key, child), childValue); ok {
+			stripped[child] = childValue
+		}
+	}
+	return stripped, true
+}
+
+func (p *persistence) append(entry *walEntry) {
+	if err := p.encoder.Encode(entry); err != nil {
+		log.Print("failed logging state write: ", err)
+		return
+	}
+	p.dirty = true
+	p.unsynced = true
+	if p.syncInterval == 0 {
+		p.sync()
+	}
+}
+
+func (p *persistence) sync() {
+	if !p.unsynced {
+		return
+	}
+	if err := p.wal.Sync(); err != nil {
+		log.Print("failed syncing state log: ", err)
+		return
+	}
+	p.unsynced = false
+}
+
+/*
+syncDir makes the renames within dir durable.
+*/
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+/*
+enablePersistence restores the state from dir and starts logging writes.
+*/
+func (sm *StateMachine) enablePersistence(dir string, persisted, ephemeral []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, WAL_FILE), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p := &persistence{
+		dir:       dir,
+		persisted: persisted,
+		ephemeral: ephemeral,
+		wal:       wal,
+		encoder:   json.NewEncoder(wal),
+	}
+	if err := sm.restore(p); err != nil {
+		wal.Close()
+		return err
+	}
+	sm.persistence = p
+	//a fresh snapshot also drops a log whose end was torn by a crash
+	p.dirty = true
+	if err := sm.snapshot(); err != nil {
+		sm.persistence = nil
+		wal.Close()
+		return err
+	}
+	log.Printf("restored state from %v", dir)
+	return nil
+}
+
+func (sm *StateMachine) restore(p *persistence) error {
+	file, err := os.Open(filepath.Join(p.dir, SNAPSHOT_FILE))
+	if err == nil {
+		state := make(map[string]interface{})
+		err = json.NewDecoder(file).Decode(&state)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		for key, value := range state {
+			sm.state[key] = value
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	file, err = os.Open(filepath.Join(p.dir, WAL_FILE))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	for {
+		entry := new(walEntry)
+		if err := decoder.Decode(entry); err != nil {
+			if err != io.EOF {
+				log.Print("stopped reading state log: ", err)
+			}
+			return nil
+		}
+		sm.apply(entry)
+	}
+}
+
+func (sm *StateMachine) apply(entry *walEntry) {
+	switch {
+	case entry.Literal && entry.Unset:
+		{
+			delete(sm.state, entry.Key)
+		}
+	case entry.Literal:
+		{
+			sm.state[entry.Key] = entry.Value
+		}
+	case entry.Unset:
+		{
+			sm.remove(entry.Key)
+		}
+	default:
+		{
+			if _, err := sm.write(entry.Key, entry.Value, nil); err != nil {
+				log.Print("failed restoring ", entry.Key, ": ", err)
+			}
+		}
+	}
+}
+
+/*
+remove deletes the dotted path key, so replaying the log drops values which
+vanished below a persisted prefix.
+*/
+func (sm *StateMachine) remove(key string) {
+	parts := strings.Split(key, ".")
+	parent, ok := sm.lookup(strings.Join(parts[:len(parts)-1], "."))
+	if len(parts) == 1 {
+		parent, ok = sm.state, true
+	}
+	if obj, isObj := parent.(map[string]interface{}); ok && isObj {
+		delete(obj, parts[len(parts)-1])
+	}
+}
+
+/*
+persist logs the value key holds after a write. Writing an object above the
+persisted prefixes logs the prefixes below it.
+*/
+func (sm *StateMachine) persist(key string, literal bool) {
+	p := sm.persistence
+	if p == nil {
+		return
+	}
+	if literal {
+		if p.persists(key) {
+			value, exists := sm.state[key]
+			p.append(&walEntry{Key: key, Value: value, Unset: !exists, Literal: true})
+		}
+		return
+	}
+	keys := []string{key}
+	if !p.persists(key) {
+		keys = keys[:0]
+		for _, prefix := range p.persisted {
+			if belowKey(prefix, key) && p.persists(prefix) {
+				keys = append(keys, prefix)
+			}
+		}
+	}
+	for _, key := range keys {
+		value, exists := sm.lookup(key)
+		value, _ = p.strip(key, value)
+		p.append(&walEntry{Key: key, Value: value, Unset: !exists})
+	}
+}
+
+/*
+snapshot writes the persisted part of the state and empties the log. The
+snapshot replaces the old one only once it is completely on disk.
+*/
+func (sm *StateMachine) snapshot() error {
+	p := sm.persistence
+	if p == nil || !p.dirty {
+		return nil
+	}
+	state, _ := p.strip("", sm.state)
+	filename := filepath.Join(p.dir, SNAPSHOT_FILE)
+	file, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(file).Encode(state)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+	//the log may only be emptied once the new snapshot survives a crash
+	if err := syncDir(p.dir); err != nil {
+		return err
+	}
+	if err := p.wal.Truncate(0); err != nil {
+		return err
+	}
+	p.dirty = false
+	p.unsynced = true
+	p.sync()
+	return nil
+}
+
+func snapshots(interval time.Duration) {
+	for range time.Tick(interval) {
+		stateMachine.cmdChan <- &command{Type: SNAPSHOT}
+	}
+}
+
+func syncs(interval time.Duration) {
+	for range time.Tick(interval) {
+		stateMachine.cmdChan <- &command{Type: SYNC}
+	}
+}
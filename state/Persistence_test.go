@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func persistentStateMachine(t *testing.T, dir string, persisted, ephemeral []string) *StateMachine {
+	sm := &StateMachine{state: make(map[string]interface{})}
+	if err := sm.enablePersistence(dir, persisted, ephemeral); err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	persisted := []string{"devices", "jobs"}
+	ephemeral := []string{"devices.cache"}
+
+	sm := persistentStateMachine(t, dir, persisted, ephemeral)
+	sm.write("devices.lamp", "on", nil)
+	sm.persist("devices.lamp", false)
+	sm.write("devices.cache.lamp", "on", nil)
+	sm.persist("devices.cache.lamp", false)
+	sm.write("session.lifetime", "10", nil)
+	sm.persist("session.lifetime", false)
+	sm.state["jobs"] = []interface{}{"a", "b"}
+	sm.persist("jobs", true)
+	if err := sm.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	//written after the snapshot, so it has to be replayed from the log
+	sm.write("devices.heater", 21, nil)
+	sm.persist("devices.heater", false)
+	sm.unset("jobs", nil)
+	sm.persist("jobs", true)
+	sm.persistence.wal.Close()
+
+	restored := persistentStateMachine(t, dir, persisted, ephemeral)
+	defer restored.persistence.wal.Close()
+	if value, ok := restored.lookup("devices.heater"); !ok || value != 21.0 {
+		t.Errorf("expected the logged write to be replayed, got %v", value)
+	}
+	if value, ok := restored.lookup("devices.lamp"); !ok || value != "on" {
+		t.Errorf("expected the write from the snapshot, got %v", value)
+	}
+	if _, ok := restored.state["jobs"]; ok {
+		t.Error("expected the logged unset to be replayed")
+	}
+	if _, ok := restored.lookup("devices.cache"); ok {
+		t.Error("ephemeral keys must not be persisted")
+	}
+	if _, ok := restored.lookup("session"); ok {
+		t.Error("keys outside the persisted prefixes must not be persisted")
+	}
+}
+
+func TestPersistenceOfParentObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	persisted := []string{"app.users"}
+
+	sm := persistentStateMachine(t, dir, persisted, nil)
+	sm.write("app", map[string]interface{}{
+		"users": map[string]interface{}{"alice": 1},
+		"tmp":   "x",
+	}, nil)
+	sm.persist("app", false)
+	sm.persistence.wal.Close()
+
+	restored := persistentStateMachine(t, dir, persisted, nil)
+	defer restored.persistence.wal.Close()
+	if value, _ := restored.lookup("app.users.alice"); value != 1.0 {
+		t.Errorf("expected the persisted prefix below the written object, got %v", value)
+	}
+	if _, ok := restored.lookup("app.tmp"); ok {
+		t.Error("keys next to the persisted prefix must not be persisted")
+	}
+
+	//replacing the object logs that the persisted prefix vanished
+	restored.write("app", "replaced", nil)
+	restored.persist("app", false)
+	restored.persistence.wal.Close()
+	again := persistentStateMachine(t, dir, persisted, nil)
+	defer again.persistence.wal.Close()
+	if value, ok := again.lookup("app.users"); ok {
+		t.Errorf("expected the logged unset of app.users to be replayed, got %v", value)
+	}
+}
+
+func TestPersistenceNeedsPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sm := persistentStateMachine(t, dir, nil, nil)
+	sm.write("devices.lamp", "on", nil)
+	sm.persist("devices.lamp", false)
+	sm.state["jobs"] = []interface{}{"a"}
+	sm.persist("jobs", true)
+	if sm.persistence.dirty {
+		t.Error("without persisted prefixes nothing must be logged")
+	}
+	sm.persistence.wal.Close()
+
+	restored := persistentStateMachine(t, dir, nil, nil)
+	defer restored.persistence.wal.Close()
+	if len(restored.state) != 0 {
+		t.Errorf("expected nothing to be restored, got %v", restored.state)
+	}
+}
+
+func TestPersistenceSyncInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sm := persistentStateMachine(t, dir, []string{"devices"}, nil)
+	defer sm.persistence.wal.Close()
+	sm.write("devices.lamp", "on", nil)
+	sm.persist("devices.lamp", false)
+	if sm.persistence.unsynced {
+		t.Error("without sync interval every write is synced")
+	}
+	sm.persistence.syncInterval = time.Second
+	sm.write("devices.lamp", "off", nil)
+	sm.persist("devices.lamp", false)
+	if !sm.persistence.unsynced {
+		t.Error("with a sync interval writes are synced in batches")
+	}
+	sm.persistence.sync()
+	if sm.persistence.unsynced {
+		t.Error("expected the batch to be synced")
+	}
+}
@@ -25,13 +25,22 @@ const (
 	ENQUEUE
 	DEQUEUE
 	UNSET
+	TRANSACTION
+	COMPARE_AND_SET
+	INCREMENT
+	SET_IF_ABSENT
+	WATCH
+	UNWATCH
+	SNAPSHOT
+	SYNC
 )
 
 type command struct {
-	Type   int
-	Key    string
-	Value  interface{}
-	Return chan interface{}
+	Type     int
+	Key      string
+	Value    interface{}
+	Expected interface{}
+	Return   chan interface{}
 }
 
 /*
@@ -42,6 +51,8 @@ type StateMachine struct {
 	state      map[string]interface{}
 	cmdChan    chan *command
 	maxListLen int
+	//nil unless the state is persisted
+	persistence *persistence
 }
 
 func (sm *StateMachine) getObject(key string) (map[string]interface{}, string, error) {
@@ -144,8 +155,35 @@ func Go() {
 	stateMachine.maxListLen = 32
 	stateMachine.cmdChan = make(chan *command, 10)
 	stateMachine.state = make(map[string]interface{})
+	if *persistenceDir != "" {
+		prefixes := append(parsePrefixes(*persistencePrefixes), alwaysPersisted...)
+		if len(prefixes) == 0 {
+			log.Print("state.persistence.prefixes is empty, no key of the state is persisted")
+		}
+		err := stateMachine.enablePersistence(*persistenceDir, prefixes, parsePrefixes(*persistenceEphemeral))
+		if err != nil {
+			log.Fatal("failed restoring the state: ", err)
+		}
+		go snapshots(parseSnapshotInterval())
+		if interval := parseSyncInterval(); interval > 0 {
+			stateMachine.persistence.syncInterval = interval
+			go syncs(interval)
+		}
+	}
 	go func() {
 		for cmd := range stateMachine.cmdChan {
+			//writes of single keys are logged and reported to the watchers afterwards
+			var before interface{}
+			switch cmd.Type {
+			case SET:
+				{
+					before, _ = stateMachine.lookup(cmd.Key)
+				}
+			case PUSH, ENQUEUE, POP, DEQUEUE, UNSET:
+				{
+					before = stateMachine.state[cmd.Key]
+				}
+			}
 			switch cmd.Type {
 			case SET:
 				{
@@ -216,8 +254,53 @@ func Go() {
 				{
 					delete(stateMachine.state, cmd.Key)
 				}
+			case TRANSACTION:
+				{
+					cmd.Return <- stateMachine.transaction(cmd.Value.([]Operation))
+				}
+			case COMPARE_AND_SET:
+				{
+					cmd.Return <- stateMachine.compareAndSet(cmd)
+				}
+			case INCREMENT:
+				{
+					cmd.Return <- stateMachine.increment(cmd)
+				}
+			case SET_IF_ABSENT:
+				{
+					cmd.Return <- stateMachine.setIfAbsent(cmd)
+				}
+			case WATCH, UNWATCH:
+				{
+					stateMachine.watch(cmd.Value.(string), cmd.Type == WATCH)
+				}
+			case SNAPSHOT:
+				{
+					if err := stateMachine.snapshot(); err != nil {
+						log.Print("failed writing state snapshot: ", err)
+					}
+				}
+			case SYNC:
+				{
+					stateMachine.persistence.sync()
+				}
+			}
+			switch cmd.Type {
+			case SET:
+				{
+					after, _ := stateMachine.lookup(cmd.Key)
+					stateMachine.persist(cmd.Key, false)
+					stateMachine.changed(cmd.Key, before, after)
+				}
+			case PUSH, ENQUEUE, POP, DEQUEUE, UNSET:
+				{
+					stateMachine.persist(cmd.Key, true)
+					stateMachine.changed(cmd.Key, before, stateMachine.state[cmd.Key])
+				}
 			}
 		}
 	}()
+	enableWatch()
+	go notify()
 	log.Print("successfully started StateMachine")
 }
@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package state
+
+/*
+A transaction is a batch of operations which the state goroutine executes in
+one go, so no other command sees or changes the state in between. If one
+operation fails, e.g. because a compare-and-swap finds another value, the
+changes of the operations before it are undone and the transaction fails
+with a *TransactionError.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	OP_GET = "get"
+	OP_SET = "set"
+	//delete Key like Unset does: the literal key, which also holds the lists of Push and Enqueue
+	OP_UNSET = "unset"
+	//set Key to Value if it currently holds Expected (nil means it must be unset)
+	OP_CAS = "cas"
+)
+
+type Operation struct {
+	Type     string      `json:"type"`
+	Key      string      `json:"key"`
+	Value    interface{} `json:"value,omitempty"`
+	Expected interface{} `json:"expected,omitempty"`
+}
+
+/*
+Returned by Transaction, Index is the operation which failed.
+*/
+type TransactionError struct {
+	Index  int
+	Reason string
+}
+
+func (err *TransactionError) Error() string {
+	return "operation " + strconv.Itoa(err.Index) + " failed: " + err.Reason
+}
+
+type transactionResult struct {
+	Values []interface{}
+	Err    error
+}
+
+/*
+Transaction executes ops atomically. The result holds the value of every get
+(and the previous value of every cas) at the index of its operation.
+*/
+func Transaction(ops []Operation) ([]interface{}, error) {
+	cmd := &command{
+		Type:   TRANSACTION,
+		Value:  ops,
+		Return: make(chan interface{}),
+	}
+	stateMachine.cmdChan <- cmd
+	result := (<-cmd.Return).(*transactionResult)
+	return result.Values, result.Err
+}
+
+/*
+ParseOperations reads operations from their json representation, e.g. the
+payload of an api request.
+*/
+func ParseOperations(data interface{}) ([]Operation, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var ops []Operation
+	if err := json.Unmarshal(encoded, &ops); err != nil {
+		return nil, err
+	}
+	for idx, op := range ops {
+		switch op.Type {
+		case OP_GET, OP_SET, OP_UNSET, OP_CAS:
+		default:
+			return nil, &TransactionError{idx, "no such operation: " + op.Type}
+		}
+	}
+	return ops, nil
+}
+
+/*
+An undo entry restores one key of one object. If existed is false the key is
+deleted, which also removes objects a write had to create on its way.
+*/
+type undoEntry struct {
+	obj     map[string]interface{}
+	key     string
+	value   interface{}
+	existed bool
+}
+
+func (sm *StateMachine) transaction(ops []Operation) *transactionResult {
+	values := make([]interface{}, len(ops))
+	undo := make([]undoEntry, 0, len(ops))
+	//the values before the transaction, to report the changes once it is committed
+	before := make(map[writtenKey]interface{})
+	written := make([]writtenKey, 0, len(ops))
+	for idx, op := range ops {
+		if op.Type != OP_GET {
+			key := writtenKey{op.Key, op.Type == OP_UNSET}
+			if _, ok := before[key]; !ok {
+				before[key] = sm.valueOf(key)
+				written = append(written, key)
+			}
+		}
+		var err error
+		switch op.Type {
+		case OP_GET:
+			{
+				values[idx], _ = sm.lookup(op.Key)
+			}
+		case OP_SET:
+			{
+				undo, err = sm.write(op.Key, op.Value, undo)
+			}
+		case OP_UNSET:
+			{
+				undo = sm.unset(op.Key, undo)
+			}
+		case OP_CAS:
+			{
+				current, _ := sm.lookup(op.Key)
+				values[idx] = current
+				if !valuesEqual(current, op.Expected) {
+					err = errors.New("compare and swap failed on " + op.Key)
+				} else {
+					undo, err = sm.write(op.Key, op.Value, undo)
+				}
+			}
+		default:
+			{
+				err = errors.New("no such operation: " + op.Type)
+			}
+		}
+		if err != nil {
+			sm.rollback(undo)
+			return &transactionResult{values, &TransactionError{idx, err.Error()}}
+		}
+	}
+	for _, key := range written {
+		sm.persist(key.Key, key.Literal)
+		sm.changed(key.Key, before[key], sm.valueOf(key))
+	}
+	return &transactionResult{values, nil}
+}
+
+/*
+writtenKey is a key changed by a transaction. Unset works on literal keys,
+the other operations on dotted paths.
+*/
+type writtenKey struct {
+	Key     string
+	Literal bool
+}
+
+func (sm *StateMachine) valueOf(key writtenKey) interface{} {
+	if key.Literal {
+		return sm.state[key.Key]
+	}
+	value, _ := sm.lookup(key.Key)
+	return value
+}
+
+/*
+lookup is like getObject, but never creates objects.
+*/
+func (sm *StateMachine) lookup(key string) (interface{}, bool) {
+	curObj := sm.state
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := curObj[part].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		curObj = next
+	}
+	value, ok := curObj[parts[len(parts)-1]]
+	return value, ok
+}
+
+func (sm *StateMachine) write(key string, value interface{}, undo []undoEntry) ([]undoEntry, error) {
+	curObj := sm.state
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := curObj[part]
+		if !ok {
+			//everything below here is new, so undoing means deleting it
+			undo = append(undo, undoEntry{obj: curObj, key: part})
+			obj, last, err := sm.getObject(key)
+			if err != nil {
+				return undo, err
+			}
+			obj[last] = value
+			return undo, nil
+		}
+		obj, ok := next.(map[string]interface{})
+		if !ok {
+			return undo, errors.New("key collision")
+		}
+		curObj = obj
+	}
+	last := parts[len(parts)-1]
+	old, existed := curObj[last]
+	undo = append(undo, undoEntry{curObj, last, old, existed})
+	curObj[last] = value
+	return undo, nil
+}
+
+/*
+unset deletes the literal key, like the UNSET command.
+*/
+func (sm *StateMachine) unset(key string, undo []undoEntry) []undoEntry {
+	if old, existed := sm.state[key]; existed {
+		undo = append(undo, undoEntry{sm.state, key, old, true})
+		delete(sm.state, key)
+	}
+	return undo
+}
+
+func (sm *StateMachine) rollback(undo []undoEntry) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		entry := undo[i]
+		if entry.existed {
+			entry.obj[entry.key] = entry.value
+		} else {
+			delete(entry.obj, entry.key)
+		}
+	}
+}
+
+/*
+valuesEqual compares like json does, so a value set as int from go equals
+the float64 a client sends.
+*/
+func valuesEqual(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	encodedA, err1 := json.Marshal(a)
+	encodedB, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(encodedA) == string(encodedB)
+}
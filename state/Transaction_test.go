@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package state
+
+import (
+	"github.com/trusch/susi/events"
+	"strconv"
+	"testing"
+)
+
+func init() {
+	events.Go()
+	Go()
+}
+
+func TestTransaction(t *testing.T) {
+	Set("tx.counter", 1)
+	values, err := Transaction([]Operation{
+		{Type: OP_GET, Key: "tx.counter"},
+		{Type: OP_CAS, Key: "tx.counter", Expected: 1.0, Value: 2},
+		{Type: OP_SET, Key: "tx.new.deep", Value: "x"},
+		{Type: OP_UNSET, Key: "tx.missing"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != 1 || values[1] != 1 {
+		t.Errorf("unexpected results: %v", values)
+	}
+	if Get("tx.counter") != 2 || Get("tx.new.deep") != "x" {
+		t.Error("transaction was not applied")
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	Set("rollback.a", "old")
+	_, err := Transaction([]Operation{
+		{Type: OP_SET, Key: "rollback.a", Value: "new"},
+		{Type: OP_UNSET, Key: "rollback.a"},
+		{Type: OP_SET, Key: "rollback.created.deep", Value: 1},
+		{Type: OP_CAS, Key: "rollback.a", Expected: "something else", Value: 1},
+	})
+	txErr, ok := err.(*TransactionError)
+	if !ok || txErr.Index != 3 {
+		t.Fatalf("expected the cas to fail, got %v", err)
+	}
+	if Get("rollback.a") != "old" {
+		t.Errorf("expected rollback.a to be restored, got %v", Get("rollback.a"))
+	}
+	if values, _ := Transaction([]Operation{{Type: OP_GET, Key: "rollback.created"}}); values[0] != nil {
+		t.Error("objects created by a failed transaction must be removed")
+	}
+}
+
+func TestTransactionUnsetsLiteralKeys(t *testing.T) {
+	key := "tx.list." + strconv.FormatUint(events.NextId(), 10)
+	Push(key, "a")
+	if _, err := Transaction([]Operation{{Type: OP_UNSET, Key: key}}); err != nil {
+		t.Fatal(err)
+	}
+	if value := Dequeue(key); value != nil {
+		t.Errorf("expected the list to be unset like Unset does, got %v", value)
+	}
+}
+
+func TestParseOperations(t *testing.T) {
+	ops, err := ParseOperations([]interface{}{
+		map[string]interface{}{"type": "cas", "key": "a", "expected": nil, "value": 1},
+	})
+	if err != nil || len(ops) != 1 || ops[0].Type != OP_CAS {
+		t.Errorf("unexpected operations %v (%v)", ops, err)
+	}
+	if _, err := ParseOperations([]interface{}{map[string]interface{}{"type": "explode"}}); err == nil {
+		t.Error("expected unknown operations to fail")
+	}
+}
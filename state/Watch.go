@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package state
+
+/*
+Changes of watched keys are published as events on CHANGED_TOPIC_PREFIX+key
+with {"key": key, "old": old value, "new": new value} as payload. Only
+subscribers with the permission state:read:<key> receive them. With
+state.watch.retain the change events are retained, so subscribers which come
+later still learn the last change of each key. The watch patterns are globs like "session.*" and are
+kept in the state itself under WATCH_KEY, so they can be set in the config
+(state.cfg: {"watch": ["session.*", "devices.*"]}) or with Watch and Unwatch.
+Changes are reported for the key which was written, writing a whole object
+does not report the keys inside it.
+*/
+
+import (
+	"flag"
+	"github.com/trusch/susi/events"
+	"github.com/trusch/susi/permissions"
+	"log"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const CHANGED_TOPIC_PREFIX = "state::changed::"
+
+const WATCH_KEY = "state.watch"
+
+var watchRetain = flag.String("state.watch.retain", "false", "whether the last change event of each watched key is retained")
+
+var retainChanges bool
+
+func parseWatchRetain() bool {
+	retain, err := strconv.ParseBool(*watchRetain)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	return retain
+}
+
+/*
+enableWatch makes the event system check the read permission of subscribers
+to change events and reads state.watch.retain.
+*/
+func enableWatch() {
+	retainChanges = parseWatchRetain()
+	events.RequirePermission(CHANGED_TOPIC_PREFIX, permissions.STATE, permissions.READ)
+}
+
+type change struct {
+	Key string
+	Old interface{}
+	New interface{}
+}
+
+/*
+The state goroutine must not wait for the event system, whose subscribers may
+use the state, so changes are queued and published by their own goroutine.
+*/
+var notifier = struct {
+	sync.Mutex
+	queue  []*change
+	signal chan bool
+}{signal: make(chan bool, 1)}
+
+func Watch(pattern string) {
+	stateMachine.cmdChan <- &command{
+		Type:  WATCH,
+		Value: pattern,
+	}
+}
+
+func Unwatch(pattern string) {
+	stateMachine.cmdChan <- &command{
+		Type:  UNWATCH,
+		Value: pattern,
+	}
+}
+
+func (sm *StateMachine) watches() []string {
+	value, _ := sm.lookup(WATCH_KEY)
+	switch list := value.(type) {
+	case []string:
+		{
+			return list
+		}
+	case []interface{}:
+		{
+			patterns := make([]string, 0, len(list))
+			for _, pattern := range list {
+				if str, ok := pattern.(string); ok {
+					patterns = append(patterns, str)
+				}
+			}
+			return patterns
+		}
+	}
+	return nil
+}
+
+func (sm *StateMachine) watch(pattern string, enable bool) {
+	old := sm.watches()
+	patterns := make([]string, 0, len(old)+1)
+	for _, existing := range old {
+		if existing != pattern {
+			patterns = append(patterns, existing)
+		}
+	}
+	if enable {
+		patterns = append(patterns, pattern)
+	}
+	before, _ := sm.lookup(WATCH_KEY)
+	if _, err := sm.write(WATCH_KEY, patterns, nil); err == nil {
+		sm.persist(WATCH_KEY, false)
+		sm.changed(WATCH_KEY, before, patterns)
+	}
+}
+
+func (sm *StateMachine) watched(key string) bool {
+	for _, pattern := range sm.watches() {
+		if ok, err := filepath.Match(pattern, key); pattern == key || (ok && err == nil) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+changed queues a change event if key is watched and the value really changed.
+*/
+func (sm *StateMachine) changed(key string, old, new interface{}) {
+	if !sm.watched(key) || valuesEqual(old, new) {
+		return
+	}
+	notifier.Lock()
+	notifier.queue = append(notifier.queue, &change{key, old, new})
+	notifier.Unlock()
+	select {
+	case notifier.signal <- true:
+	default:
+	}
+}
+
+func notify() {
+	for range notifier.signal {
+		notifier.Lock()
+		queue := notifier.queue
+		notifier.queue = nil
+		notifier.Unlock()
+		for _, change := range queue {
+			event := events.NewEvent(CHANGED_TOPIC_PREFIX+change.Key, map[string]interface{}{
+				"key": change.Key,
+				"old": change.Old,
+				"new": change.New,
+			})
+			event.Retain = retainChanges
+			events.Publish(event)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package state
+
+import (
+	"github.com/trusch/susi/events"
+	"github.com/trusch/susi/permissions"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func nextChange(t *testing.T, ch chan *events.Event) map[string]interface{} {
+	select {
+	case event := <-ch:
+		{
+			return event.Payload.(map[string]interface{})
+		}
+	case <-time.After(time.Second):
+		{
+			t.Fatal("no change event")
+		}
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	//only changes are reported, so every run needs keys which were never set
+	prefix := "watched" + strconv.FormatUint(events.NextId(), 10)
+	Watch(prefix + ".*")
+	ch, closeChan := events.Subscribe(CHANGED_TOPIC_PREFIX+prefix+".*", 0)
+	defer func() { closeChan <- true }()
+
+	Set(prefix+".a", 1)
+	Set(prefix+".a", 1)
+	Set("un"+prefix+".a", 1)
+	Set(prefix+".a", 2)
+	change := nextChange(t, ch)
+	if change["key"] != prefix+".a" || change["old"] != nil || change["new"] != 1 {
+		t.Errorf("unexpected change: %v", change)
+	}
+	if change = nextChange(t, ch); change["old"] != 1 || change["new"] != 2 {
+		t.Errorf("setting the same value must not be reported, got %v", change)
+	}
+
+	Transaction([]Operation{
+		{Type: OP_SET, Key: prefix + ".b", Value: "x"},
+		{Type: OP_SET, Key: prefix + ".b", Value: "y"},
+	})
+	if change = nextChange(t, ch); change["key"] != prefix+".b" || change["new"] != "y" {
+		t.Errorf("a transaction must report the committed value once, got %v", change)
+	}
+	Increment(prefix+".c", 3)
+	if change = nextChange(t, ch); change["key"] != prefix+".c" || change["new"] != 3.0 {
+		t.Errorf("unexpected change: %v", change)
+	}
+
+	Unwatch(prefix + ".*")
+	Set(prefix+".a", 3)
+	select {
+	case event := <-ch:
+		{
+			t.Errorf("unwatched key was reported: %v", event.Payload)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchPermissions(t *testing.T) {
+	permissions.DefineRole("watch-reader", "events:*:*", "state:read:permitted.*")
+	defer permissions.RemoveRole("watch-reader")
+	Watch("permitted.*")
+	Watch("secret.*")
+	defer Unwatch("permitted.*")
+	defer Unwatch("secret.*")
+	pin := "secret.pin" + strconv.FormatUint(events.NextId(), 10)
+	lamp := "permitted.lamp" + strconv.FormatUint(events.NextId(), 10)
+	ch, closeChan := events.SubscribeWithOptions(CHANGED_TOPIC_PREFIX+"#", 5, events.SubscribeOptions{Roles: []string{"watch-reader"}})
+	defer func() { closeChan <- true }()
+
+	Set(pin, 1234)
+	Set(lamp, "on")
+	if change := nextChange(t, ch); change["key"] != lamp {
+		t.Errorf("expected only the readable key, got %v", change)
+	}
+	if events.CanSubscribe(CHANGED_TOPIC_PREFIX+pin, "", []string{"watch-reader"}, 5) {
+		t.Error("subscribing to changes of unreadable keys must be denied")
+	}
+
+	//change events are not retained, so late subscribers see nothing
+	late, closeLate := events.Subscribe(CHANGED_TOPIC_PREFIX+lamp, 0)
+	defer func() { closeLate <- true }()
+	select {
+	case event := <-late:
+		t.Errorf("unexpected retained change: %v", event.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
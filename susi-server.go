@@ -22,6 +22,8 @@ import (
 	"github.com/trusch/susi/enginestarter"
 	"github.com/trusch/susi/events"
 	"github.com/trusch/susi/jsengine"
+	"github.com/trusch/susi/permissions"
+	"github.com/trusch/susi/scheduler"
 	"github.com/trusch/susi/session"
 	"github.com/trusch/susi/state"
 	"github.com/trusch/susi/webstack"
@@ -68,10 +70,24 @@ func main() {
 
 	state.Go()
 	config.Go()
+	if err := events.LoadACL(state.Get("events.acl")); err != nil {
+		log.Fatal("failed to load event acl: ", err)
+	}
+	if err := events.LoadRateLimits(state.Get("events.ratelimits")); err != nil {
+		log.Fatal("failed to load event rate limits: ", err)
+	}
+	if err := events.LoadConsumers(state.Get("events.consumers")); err != nil {
+		log.Fatal("failed to load durable consumers: ", err)
+	}
+	if err := permissions.Load(state.Get("permissions")); err != nil {
+		log.Fatal("failed to load permissions: ", err)
+	}
 	session.Go()
 	apiserver.Go()
 	autodiscovery.Go()
 	authentification.Go()
+	//schedules which were missed while down fire right away and need the users
+	scheduler.Go()
 	webstack.Go()
 	firebirdconnector.Go()
 	jsengine.Go()
@@ -112,20 +112,31 @@ func (ptr *AuthHandler) checkUser(username, password string) *authentification.U
 	if err != nil {
 		return nil
 	}
-	return data.(*authentification.User)
+	user := new(authentification.User)
+	if err := events.DecodeAs(data, user); err != nil {
+		log.Print(err)
+		return nil
+	}
+	return user
 }
 
 func (ptr *AuthHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	sessionId, err := ptr.sessionHandling(resp, req)
 	data, err := events.Request("session::get", sessionId)
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
 	session := data.(*session.Session)
 	req.Header.Del("authlevel")
 	req.Header.Add("authlevel", strconv.Itoa(int(session.Data["authlevel"].(uint8))))
 	req.Header.Del("username")
 	req.Header.Add("username", session.Data["username"].(string))
+	req.Header.Del("roles")
+	if roles, ok := session.Data["roles"].([]string); ok {
+		req.Header.Add("roles", strings.Join(roles, ","))
+	}
 	req.Header.Del("sessionid")
 	req.Header.Add("sessionid", strconv.Itoa(int(session.Id)))
 	//log.Print("SESSION:", session)
@@ -155,6 +166,7 @@ func (ptr *AuthHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 				if user := ptr.checkUser(username, password); user != nil {
 					session.Data["authlevel"] = user.AuthLevel
 					session.Data["username"] = user.Username
+					session.Data["roles"] = user.Roles
 					log.Print("successfully logged in for user: ", msg.Username)
 					resp.WriteHeader(http.StatusOK)
 					return
@@ -168,6 +180,7 @@ func (ptr *AuthHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 			{
 				session.Data["authlevel"] = uint8(3)
 				session.Data["username"] = "anonymous"
+				delete(session.Data, "roles")
 				resp.WriteHeader(http.StatusOK)
 				return
 			}
@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var eventQueueSize = flag.String("webstack.eventqueuesize", "100", "How many events should be queued for each session")
@@ -41,6 +42,7 @@ type eventsCmd struct {
 	Topic     string
 	Id        string
 	AuthLevel uint8
+	Options   events.SubscribeOptions
 	Payload   interface{}
 	Result    chan interface{}
 }
@@ -83,7 +85,7 @@ func (handler *EventsHandler) backend() {
 			}
 		case SUBSCRIBE:
 			{
-				handler.subscribe(cmd.Id, cmd.Topic, cmd.AuthLevel)
+				handler.subscribe(cmd.Id, cmd.Topic, cmd.AuthLevel, cmd.Options)
 			}
 		case UNSUBSCRIBE:
 			{
@@ -120,9 +122,9 @@ func (handler *EventsHandler) getEvents(id string) []*events.Event {
 	return events
 }
 
-func (handler *EventsHandler) subscribe(id, topic string, authlevel uint8) {
-	eventChan, closeChan := events.Subscribe(topic, authlevel)
-	close2 := make(chan bool)
+func (handler *EventsHandler) subscribe(id, topic string, authlevel uint8, options events.SubscribeOptions) {
+	eventChan, closeChan := events.SubscribeWithOptions(topic, authlevel, options)
+	close2 := make(chan bool, 1)
 	subscriptions := handler.subscriptions[id]
 	for _, sub := range subscriptions {
 		if sub.Topic == topic {
@@ -143,8 +145,11 @@ func (handler *EventsHandler) subscribe(id, topic string, authlevel uint8) {
 				{
 					return
 				}
-			case event := <-eventChan:
+			case event, ok := <-eventChan:
 				{
+					if !ok {
+						return
+					}
 					handler.cmdChan <- &eventsCmd{
 						Type:    ADDEVENT,
 						Id:      id,
@@ -197,6 +202,11 @@ func (ptr *EventsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 	authlevel_, _ := strconv.Atoi(req.Header.Get("authlevel"))
 	authlevel := uint8(authlevel_)
 	username := req.Header.Get("username")
+	sessionId, _ := strconv.ParseUint(req.Header.Get("sessionid"), 10, 64)
+	var roles []string
+	if header := req.Header.Get("roles"); header != "" {
+		roles = strings.Split(header, ",")
+	}
 	path := req.URL.Path
 	switch {
 	case strings.HasPrefix(path, "/events/publish"):
@@ -208,6 +218,9 @@ func (ptr *EventsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 				AuthLevel  uint8       `json:"authlevel"`
 				ReturnAddr string      `json:"returnaddr"`
 				Payload    interface{} `json:"payload"`
+				Retain     bool        `json:"retain"`
+				TraceId    uint64      `json:"traceid,string"`
+				ParentId   uint64      `json:"parentid,string"`
 			}
 			msg := new(publishMsg)
 			err := decoder.Decode(&msg)
@@ -224,7 +237,31 @@ func (ptr *EventsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 			event.AuthLevel = msg.AuthLevel
 			event.ReturnAddr = msg.ReturnAddr
 			event.Username = username
-			events.Publish(event)
+			event.Roles = roles
+			event.SessionId = sessionId
+			event.Retain = msg.Retain
+			event.TraceId = msg.TraceId
+			event.ParentId = msg.ParentId
+			events.MarkResponder(event, "session:"+strconv.FormatUint(sessionId, 10))
+			if err := events.TryPublish(event); err != nil {
+				switch err.(type) {
+				case *events.RejectedError, *events.AccessDeniedError:
+					{
+						http.Error(resp, err.Error(), http.StatusForbidden)
+						return
+					}
+				case *events.RateLimitError:
+					{
+						http.Error(resp, err.Error(), http.StatusTooManyRequests)
+						return
+					}
+				case *events.PayloadError:
+					{
+						http.Error(resp, err.Error(), http.StatusBadRequest)
+						return
+					}
+				}
+			}
 			resp.WriteHeader(http.StatusOK)
 			return
 		}
@@ -233,8 +270,11 @@ func (ptr *EventsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 			reader := io.LimitReader(req.Body, 1024)
 			decoder := json.NewDecoder(reader)
 			type subscribeMsg struct {
-				Key       string `json:"key"`
-				AuthLevel uint8  `json:"authlevel"`
+				Key       string                 `json:"key"`
+				AuthLevel uint8                  `json:"authlevel"`
+				Offset    uint64                 `json:"offset"`
+				Since     int64                  `json:"since"`
+				Filter    map[string]interface{} `json:"filter"`
 			}
 			msg := new(subscribeMsg)
 			err := decoder.Decode(&msg)
@@ -247,11 +287,31 @@ func (ptr *EventsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 			if msg.AuthLevel < authlevel {
 				msg.AuthLevel = authlevel
 			}
+			if err := events.CheckSubscribe(msg.Key, username, roles, msg.AuthLevel); err != nil {
+				http.Error(resp, err.Error(), http.StatusForbidden)
+				return
+			}
+			options := events.SubscribeOptions{
+				Policy:     events.DROP_OLDEST,
+				FromOffset: msg.Offset,
+				Username:   username,
+				Roles:      roles,
+			}
+			if msg.Since > 0 {
+				options.FromTime = time.Unix(msg.Since, 0)
+			}
+			if msg.Filter != nil {
+				if options.Filter, err = events.ParseFilter(msg.Filter); err != nil {
+					resp.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
 			ptr.cmdChan <- &eventsCmd{
 				Type:      SUBSCRIBE,
 				Id:        id,
 				Topic:     msg.Key,
 				AuthLevel: msg.AuthLevel,
+				Options:   options,
 			}
 			resp.WriteHeader(http.StatusOK)
 			return
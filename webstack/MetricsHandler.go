@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2014, webvariants GmbH, http://www.webvariants.de
+ *
+ * This file is released under the terms of the MIT license. You can find the
+ * complete text in the attached LICENSE file or online at:
+ *
+ * http://www.opensource.org/licenses/mit-license.php
+ *
+ * @author: Tino Rusch (tino.rusch@webvariants.de)
+ */
+
+package webstack
+
+import (
+	"github.com/trusch/susi/events"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+MetricsHandler serves the stats of the event system in the Prometheus text
+format. Scrapers need the same rights as subscribers of events.STATS_TOPIC.
+*/
+type MetricsHandler struct{}
+
+func NewMetricsHandler() *MetricsHandler {
+	return new(MetricsHandler)
+}
+
+func (ptr *MetricsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	authlevel, _ := strconv.Atoi(req.Header.Get("authlevel"))
+	var roles []string
+	if header := req.Header.Get("roles"); header != "" {
+		roles = strings.Split(header, ",")
+	}
+	if !events.CanSubscribe(events.STATS_TOPIC, req.Header.Get("username"), roles, uint8(authlevel)) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := events.WritePrometheus(resp); err != nil {
+		log.Print(err)
+	}
+}
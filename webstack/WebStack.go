@@ -44,6 +44,7 @@ func Go() {
 	handler := http.NewServeMux()
 	handler.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir(assetsDir))))
 	handler.Handle("/events/", eventsHandler)
+	handler.Handle("/metrics", NewMetricsHandler())
 	handler.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
 		req := ws.Request()
 		sessionId_, _ := strconv.Atoi(req.Header.Get("sessionid"))